@@ -0,0 +1,98 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package build
+
+import (
+	// Stdlib
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	// Cider
+	"github.com/cider/cider/data"
+	"github.com/cider/cider/utils/archive"
+)
+
+// ErrNoArtifacts is returned when the build succeeds, but the artifacts
+// were not received.
+var ErrNoArtifacts = errors.New("build artifacts not received")
+
+// artifactsReceiver unpacks the artifacts frames as they arrive.
+type artifactsReceiver struct {
+	tag      string
+	pw       *io.PipeWriter
+	doneCh   chan error
+	finished bool
+}
+
+func newArtifactsReceiver(dir, tag string) *artifactsReceiver {
+	pr, pw := io.Pipe()
+	receiver := &artifactsReceiver{
+		tag:    tag,
+		pw:     pw,
+		doneCh: make(chan error, 1),
+	}
+	go func() {
+		err := os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = archive.Unpack(pr, dir)
+		}
+		// Make sure the writes do not block in case unpacking failed.
+		pr.CloseWithError(err)
+		receiver.doneCh <- err
+	}()
+	return receiver
+}
+
+// HandleLine consumes the artifacts frames. It returns false for other lines.
+func (receiver *artifactsReceiver) HandleLine(line string) bool {
+	kind, payload, ok, err := data.ParseArtifactsFrame(line, receiver.tag)
+	if !ok {
+		return false
+	}
+	if receiver.finished {
+		return true
+	}
+	if err != nil {
+		receiver.finish(err)
+		return true
+	}
+
+	switch kind {
+	case data.ArtifactsData:
+		// The error is returned by Unpack as well, so it can be ignored here.
+		receiver.pw.Write(payload)
+	case data.ArtifactsEnd:
+		receiver.finish(nil)
+	case data.ArtifactsError:
+		receiver.finish(errors.New(string(payload)))
+	}
+	return true
+}
+
+func (receiver *artifactsReceiver) finish(err error) {
+	receiver.finished = true
+	receiver.pw.CloseWithError(err)
+}
+
+// Wait waits for the artifacts to be unpacked. It returns ErrNoArtifacts in
+// case the artifacts were not received completely.
+func (receiver *artifactsReceiver) Wait() error {
+	if !receiver.finished {
+		receiver.finish(ErrNoArtifacts)
+	}
+	return <-receiver.doneCh
+}
+
+func mustRandomTag() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
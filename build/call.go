@@ -8,15 +8,24 @@ package build
 import (
 	// Stdlib
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// Cider
 	"github.com/cider/cider/data"
 
 	// Meeko
+	"github.com/meeko/go-meeko/meeko/services"
 	"github.com/meeko/go-meeko/meeko/services/rpc"
 	ws "github.com/meeko/go-meeko/meeko/transports/websocket/rpc"
 
@@ -27,57 +36,329 @@ import (
 
 const TokenHeader = "X-Meeko-Token"
 
+// ErrConnectionLost is returned by BuildRequest.Wait when the connection to
+// the build master is lost before the build request is resolved.
+var ErrConnectionLost = errors.New("connection to the build master lost")
+
+// RejectReason is a machine-readable reason for the build request being
+// rejected by the build master before reaching any build slave.
+type RejectReason string
+
+const (
+	ReasonNoProvider     RejectReason = "no-provider"
+	ReasonDispatchFailed RejectReason = "dispatch-failed"
+)
+
+// The return codes the build master uses when rejecting requests.
+// The build slaves never use these, so they can be told apart easily.
+// These are the only codes the broker sends, finer-grained reasons
+// belong in meekod and go-meeko.
+var rejectReasons = map[rpc.ReturnCode]RejectReason{
+	254: ReasonNoProvider,
+	255: ReasonDispatchFailed,
+}
+
+var rejectMessages = map[RejectReason]string{
+	ReasonNoProvider:     "no build slave is available for the requested method",
+	ReasonDispatchFailed: "failed to dispatch the request to a build slave",
+}
+
+// ErrRejected is returned by BuildRequest.Wait when the build master rejects
+// the request. No build slave has been contacted in that case.
+type ErrRejected struct {
+	Code   rpc.ReturnCode
+	Reason RejectReason
+
+	// Detail explains the reason in more detail, when known.
+	// See Session.ExplainRejection.
+	Detail string
+}
+
+func (err *ErrRejected) Error() string {
+	msg := rejectMessages[err.Reason]
+	if err.Detail != "" {
+		msg = err.Detail
+	}
+	return fmt.Sprintf("build request rejected: %v (%v)", msg, err.Reason)
+}
+
+// rejection returns the error for the calls rejected by the build master,
+// nil in case the call was not rejected.
+func rejection(call *rpc.RemoteCall) *ErrRejected {
+	code := call.ReturnCode()
+	reason, ok := rejectReasons[code]
+	if !ok {
+		return nil
+	}
+
+	return &ErrRejected{Code: code, Reason: reason}
+}
+
 type Session struct {
 	*rpc.Service
+
+	master string
+	token  string
+	tls    *tls.Config
 }
 
 func Dial(master, token string) (*Session, error) {
-	service, err := rpc.NewService(func() (rpc.Transport, error) {
+	return DialTLS(master, token, nil)
+}
+
+// DialTLS is like Dial, but the given TLS configuration is used for wss://
+// URLs, e.g. to trust a private certificate authority. The defaults are
+// used when tlsConfig is nil.
+func DialTLS(master, token string, tlsConfig *tls.Config) (*Session, error) {
+	service, err := dial(master, token, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{service, master, token, tlsConfig}, nil
+}
+
+func dial(master, token string, tlsConfig *tls.Config) (*rpc.Service, error) {
+	return rpc.NewService(func() (rpc.Transport, error) {
 		factory := ws.NewTransportFactory()
 		factory.Server = master
 		factory.Origin = "http://localhost"
 		factory.WSConfigFunc = func(config *websocket.Config) {
 			config.Header.Set(TokenHeader, token)
+			if tlsConfig != nil {
+				config.TlsConfig = tlsConfig
+			}
 		}
 		return factory.NewTransport("cider#" + mustRandomString())
 	})
+}
+
+// redial replaces the connection to the build master with a new one.
+func (s *Session) redial() error {
+	s.Service.Close()
+	service, err := dial(s.master, s.token, s.tls)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &Session{service}, nil
+	s.Service = service
+	return nil
 }
 
 func (s *Session) NewBuildRequest(method string, args *data.BuildArgs) *BuildRequest {
-	return &BuildRequest{s.Service.NewRemoteCall(method, args)}
+	return &BuildRequest{
+		RemoteCall:  s.Service.NewRemoteCall(method, args),
+		method:      method,
+		args:        args,
+		session:     s,
+		interruptCh: make(chan struct{}),
+		mu:          new(sync.Mutex),
+	}
 }
 
 type BuildRequest struct {
 	*rpc.RemoteCall
+
+	// ArtifactsDir is the directory the build artifacts are unpacked into.
+	// It must be set for the artifacts requested using BuildArgs.Artifacts
+	// to be received. The artifacts frames are removed from Stdout.
+	ArtifactsDir string
+
+	// Retries is the number of times the request is sent again when the
+	// connection to the build master fails before any output is received.
+	// The session is connected again for every retry. The request is never
+	// retried once the output has started or the request has been
+	// interrupted, nor when the request fails for other reasons than
+	// the connection. Use BuildArgs.IdempotencyKey to make sure that a build
+	// that has already started is not run again.
+	Retries int
+
+	// RetryBackoff is the delay before the first retry. It is doubled for
+	// every following retry.
+	RetryBackoff time.Duration
+
+	method    string
+	args      *data.BuildArgs
+	session   *Session
+	artifacts *artifactsReceiver
+	filter    *controlFilter
+	output    *outputWatcher
+	attempt   int
+
+	// Interrupt can be called from another goroutine while the request is
+	// being retried, so the interrupt and replacing RemoteCall are guarded.
+	interruptCh chan struct{}
+	interrupted bool
+	mu          *sync.Mutex
+}
+
+// Disconnected returns a channel that is closed when the connection to
+// the build master is lost. The request cannot be resolved after that.
+func (request *BuildRequest) Disconnected() <-chan struct{} {
+	return request.session.Closed()
 }
 
 func (request *BuildRequest) Execute() (result *data.BuildResult, err error) {
-	request.RemoteCall.GoExecute()
+	request.GoExecute()
 	return request.Wait()
 }
 
+func (request *BuildRequest) GoExecute() {
+	if request.ArtifactsDir != "" && len(request.args.Artifacts) != 0 {
+		// The tag is kept when the request is retried so that the build
+		// can be recognised by the idempotency key.
+		if request.args.ArtifactsTag == "" {
+			request.args.ArtifactsTag = mustRandomTag()
+		}
+		request.artifacts = newArtifactsReceiver(request.ArtifactsDir, request.args.ArtifactsTag)
+		if request.Stdout == nil {
+			request.Stdout = ioutil.Discard
+		}
+		request.filter = newControlFilter(request.Stdout, request.artifacts.HandleLine)
+		request.Stdout = request.filter
+	}
+	if request.Retries != 0 {
+		request.output = new(outputWatcher)
+		request.Stdout = request.output.watch(request.Stdout)
+		request.Stderr = request.output.watch(request.Stderr)
+	}
+	request.RemoteCall.GoExecute()
+}
+
+// Interrupt interrupts the request. It is safe to call it while the request
+// is being retried, no more retries happen then.
+func (request *BuildRequest) Interrupt() error {
+	request.mu.Lock()
+	if !request.interrupted {
+		request.interrupted = true
+		close(request.interruptCh)
+	}
+	call := request.RemoteCall
+	request.mu.Unlock()
+	return call.Interrupt()
+}
+
+// retry sends the request again using a new connection, if allowed.
+// It returns false when the request is not to be retried. err is set in case
+// the request was interrupted while waiting for the retry.
+func (request *BuildRequest) retry(cause error) (ok bool, err error) {
+	if request.attempt >= request.Retries || !isTransportError(cause) || request.output.started() {
+		return false, nil
+	}
+	request.attempt++
+
+	delay := request.RetryBackoff << uint(request.attempt-1)
+	verbose("@{c}>>>@{|} Build request failed: ", cause, "\n")
+	verbose("@{c}>>>@{|} Retrying in ", delay, " (attempt ", request.attempt, " of ", request.Retries, ")\n")
+	select {
+	case <-time.After(delay):
+	case <-request.interruptCh:
+		return false, rpc.ErrInterrupted
+	}
+
+	if err := request.session.redial(); err != nil {
+		verbose("@{c}>>>@{|} Failed to connect to the build master: ", err, "\n")
+		return request.retry(err)
+	}
+
+	call := request.session.Service.NewRemoteCall(request.method, request.args)
+	call.Stdout = request.Stdout
+	call.Stderr = request.Stderr
+	call.OnProgress = request.OnProgress
+
+	request.mu.Lock()
+	defer request.mu.Unlock()
+	if request.interrupted {
+		return false, rpc.ErrInterrupted
+	}
+	request.RemoteCall = call
+	call.GoExecute()
+	return true, nil
+}
+
+// isTransportError tells whether err means that the connection to the build
+// master failed, so that the request can be sent again. The request is not
+// retried on other errors, e.g. protocol errors, which would fail again.
+func isTransportError(err error) bool {
+	switch err {
+	case ErrConnectionLost, io.EOF, io.ErrUnexpectedEOF, websocket.ErrBadStatus:
+		return true
+	}
+	switch err := err.(type) {
+	case *services.ErrTerminated:
+		return true
+	case *websocket.DialError:
+		return isTransportError(err.Err)
+	case net.Error:
+		return true
+	}
+	return false
+}
+
 func (request *BuildRequest) Wait() (result *data.BuildResult, err error) {
-	err = request.RemoteCall.Wait()
+	// Pending calls are never resolved when the connection is lost,
+	// so the connection must be watched as well. The decision to retry
+	// is made before the artifacts are touched, the artifacts receiver is
+	// shared by all the attempts since no output is received before a retry.
+	for {
+		select {
+		case <-request.Resolved():
+			err = request.RemoteCall.Wait()
+		case <-request.Disconnected():
+			// The call can be resolved right before the connection is lost,
+			// the build must not be run again then.
+			select {
+			case <-request.Resolved():
+				err = request.RemoteCall.Wait()
+			default:
+				err = ErrConnectionLost
+			}
+		}
+		if err == nil {
+			break
+		}
+		retried, ex := request.retry(err)
+		if ex != nil {
+			err = ex
+		}
+		if !retried {
+			break
+		}
+	}
+
+	// Finish receiving the artifacts, if requested. The error only matters
+	// when the build succeeds, the artifacts are not sent otherwise.
+	var artifactsErr error
+	if request.artifacts != nil {
+		if err == nil {
+			request.filter.Flush()
+		}
+		artifactsErr = request.artifacts.Wait()
+	}
 	if err != nil {
 		return
 	}
 
+	// The return value is not a BuildResult in case the request was rejected.
+	if rejected := rejection(request.RemoteCall); rejected != nil {
+		err = rejected
+		return
+	}
+
 	var res data.BuildResult
 	err = request.RemoteCall.UnmarshalReturnValue(&res)
 	if err != nil {
 		return
 	}
+	if artifactsErr != nil && res.Error == "" {
+		err = fmt.Errorf("failed to receive the build artifacts: %v", artifactsErr)
+		return
+	}
 
 	result = &res
 	return
 }
 
-func call(master, token, method string, args *data.BuildArgs) (*data.BuildResult, error) {
+func call(master, token, method string, args *data.BuildArgs) (*data.BuildResult, rpc.ReturnCode, error) {
 	// Make sure all arguments are set.
 	var unset string
 	switch {
@@ -94,49 +375,153 @@ func call(master, token, method string, args *data.BuildArgs) (*data.BuildResult
 		panic(fmt.Errorf("call(): argument is empty: %v", unset))
 	}
 
-	// Create a Cider RPC client that uses WebSocket transport.
-	fmt.Printf("---> Connecting to %v\n", master)
-	session, err := Dial(master, token)
-	if err != nil {
-		return nil, err
+	// Open the event sink if requested. The build goes on without it
+	// in case it cannot be opened.
+	var events *EventSink
+	if eventsPath != "" {
+		sink, err := OpenEventSink(eventsPath)
+		if err != nil {
+			fmt.Fprintf(console, "---> Not emitting build events: %v\n", err)
+		}
+		events = sink
+		defer events.Close()
 	}
-	defer session.Close()
+	events.Emit(&Event{Type: EventStarted, Method: method})
 
-	fmt.Printf("---> Sending the build request (using method %q)\n", method)
+	result, code, err := doCall(master, token, method, args, events)
 
+	finished := &Event{Type: EventFinished, Method: method, Result: result}
+	if err != nil {
+		finished.Error = err.Error()
+	} else if result.Error != "" {
+		finished.Error = result.Error
+	}
+	events.Emit(finished)
+	return result, code, err
+}
+
+func doCall(master, token, method string, args *data.BuildArgs, events *EventSink) (*data.BuildResult, rpc.ReturnCode, error) {
+	// Create a Cider RPC client that uses WebSocket transport.
 	// Start catching signals.
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt)
+	defer signal.Stop(signalCh)
+
+	fmt.Fprintf(console, "---> Connecting to %v\n", master)
+	events.Phase(method, PhaseConnecting)
+
+	// The retries are shared by connecting and sending the request.
+	var attempt uint
+	session, err := DialTLS(master, token, tlsConfig)
+	for err != nil && attempt < retries && isTransportError(err) {
+		attempt++
+		delay := retryBackoff << (attempt - 1)
+		verbose("@{c}>>>@{|} Failed to connect to the build master: ", err, "\n")
+		verbose("@{c}>>>@{|} Retrying in ", delay, " (attempt ", attempt, " of ", retries, ")\n")
+		select {
+		case <-time.After(delay):
+		case <-signalCh:
+			return nil, 0, rpc.ErrInterrupted
+		}
+		session, err = DialTLS(master, token, tlsConfig)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+
+	fmt.Fprintf(console, "---> Sending the build request (using method %q)\n", method)
+	events.Phase(method, PhaseSending)
 
 	// Configure the RPC call.
 	call := session.NewBuildRequest(method, args)
-	call.Stdout = os.Stdout
+	call.Stdout = console
 	call.Stderr = os.Stderr
+	call.ArtifactsDir = artifactsDir
+	call.Retries = int(retries - attempt)
+	call.RetryBackoff = retryBackoff << attempt
+	if events != nil {
+		// The first output means that a build slave got the request.
+		running := new(sync.Once)
+		call.Stdout = &phaseWriter{console, running, events, method}
+		call.Stderr = &phaseWriter{os.Stderr, running, events, method}
+	}
+	// The progress lines are rendered separately from the build output.
+	progress := newProgressFilter(call.Stdout, newProgressRenderer(os.Stderr))
+	call.Stdout = progress
 
 	// Execute the remote call.
 	verbose("@{c}>>>@{|} Calling ", method, " ... ")
 	call.GoExecute()
 
+	// Interrupt the build on SIGINT. The signal is watched until the request
+	// is resolved, including while the request is being retried.
+	waitDone := make(chan struct{})
+	defer close(waitDone)
+	go func() {
+		select {
+		case <-signalCh:
+			fmt.Fprintln(console, "---> Interrupting the build job, this can take a few seconds")
+			events.Phase(method, PhaseInterrupting)
+			if err := call.Interrupt(); err != nil {
+				fmt.Fprintf(console, "---> Failed to interrupt the build job: %v\n", err)
+			}
+		case <-waitDone:
+		}
+	}()
+
 	// Wait for the remote call to be resolved.
 	verbose("@{c}>>>@{|} Combined output\n")
-	select {
-	case <-call.Resolved():
-	case <-signalCh:
-		fmt.Println("---> Interrupting the build job, this can take a few seconds")
-		if err := call.Interrupt(); err != nil {
-			return nil, err
-		}
-	}
-	verbose("@{c}<<<@{|} Combined output\n")
 	result, err := call.Wait()
+	verbose("@{c}<<<@{|} Combined output\n")
+	progress.Flush()
 	if err != nil {
-		return nil, err
+		if ex, ok := err.(*ErrRejected); ok {
+			session.ExplainRejection(ex, method)
+		}
+		if err == ErrConnectionLost {
+			fmt.Fprintln(console, "---> Connection to the build master lost, the build result is unknown")
+			if ex := session.Wait(); ex != nil {
+				verbose("@{c}>>>@{|} Connection error: ", ex, "\n")
+			}
+		}
+		return nil, 0, err
+	}
+	if result.Slave != "" {
+		fmt.Fprintf(console, "---> The build was processed by slave %q\n", result.Slave)
 	}
 
 	// Return the results.
 	verbose("@{c}>>>@{|} Return code:  ", call.ReturnCode(), "\n")
 	verbose("@{c}>>>@{|} Return value: ", result, "\n")
-	return result, err
+	return result, call.ReturnCode(), err
+}
+
+// outputWatcher tells whether any output has been written through
+// the writers it watches.
+type outputWatcher struct {
+	flag uint32
+}
+
+func (watcher *outputWatcher) watch(w io.Writer) io.Writer {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	return &watchedWriter{w, watcher}
+}
+
+func (watcher *outputWatcher) started() bool {
+	return atomic.LoadUint32(&watcher.flag) != 0
+}
+
+type watchedWriter struct {
+	w       io.Writer
+	watcher *outputWatcher
+}
+
+func (ww *watchedWriter) Write(p []byte) (int, error) {
+	atomic.StoreUint32(&ww.watcher.flag, 1)
+	return ww.w.Write(p)
 }
 
 func mustRandomString() string {
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package build
+
+import (
+	// Stdlib
+	"fmt"
+	"strings"
+
+	// Cider
+	"github.com/cider/cider/data"
+)
+
+// Capabilities asks a build slave exporting the given label for the labels,
+// runners, workspace and the number of executors it has registered.
+// The slave identity can be used as the label to ask a particular slave.
+func (s *Session) Capabilities(slaveLabel string) (*data.Capabilities, error) {
+	call := s.Service.NewRemoteCall(fmt.Sprintf("cider.%v.capabilities", slaveLabel), nil)
+	call.GoExecute()
+
+	// Pending calls are never resolved when the connection is lost.
+	select {
+	case <-call.Resolved():
+	case <-s.Closed():
+		return nil, ErrConnectionLost
+	}
+	if err := call.Wait(); err != nil {
+		return nil, err
+	}
+
+	if rejected := rejection(call); rejected != nil {
+		return nil, rejected
+	}
+	if code := call.ReturnCode(); code != 0 {
+		return nil, fmt.Errorf("capabilities request failed with return code %v", code)
+	}
+
+	var caps data.Capabilities
+	if err := call.UnmarshalReturnValue(&caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
+
+// ExplainRejection sets err.Detail when the build request for method was
+// rejected because there was no build slave exporting the method. It tells
+// whether there is no build slave with the label connected at all or whether
+// the runner is not supported by the slaves connected, which is found out
+// by asking the slaves with the label for their capabilities.
+func (s *Session) ExplainRejection(err *ErrRejected, method string) {
+	if err.Reason != ReasonNoProvider {
+		return
+	}
+
+	// The method is cider.LABEL.RUNNER.
+	parts := strings.Split(method, ".")
+	if len(parts) < 3 || parts[0] != "cider" {
+		return
+	}
+	label := strings.Join(parts[1:len(parts)-1], ".")
+	runner := parts[len(parts)-1]
+
+	caps, ex := s.Capabilities(label)
+	if ex != nil {
+		if _, ok := ex.(*ErrRejected); ok {
+			err.Detail = fmt.Sprintf("no build slave with label or identity %q is connected", label)
+		}
+		return
+	}
+	err.Detail = fmt.Sprintf("build slaves with label %q are connected, but none of them "+
+		"supports runner %q (slave %q supports %v)",
+		label, runner, caps.Slave, strings.Join(caps.Runners, ", "))
+}
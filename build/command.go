@@ -7,12 +7,19 @@ package build
 
 import (
 	// Stdlib
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	// Cider
 	"github.com/cider/cider/data"
+	"github.com/cider/cider/utils"
 
 	// Others
 	"github.com/cihub/seelog"
@@ -20,22 +27,58 @@ import (
 )
 
 var (
-	verboseMode bool
-	master      string
-	token       string
-	slave       string
-	repository  string
-	script      string
-	runner      string
-	env         = data.Env(make([]string, 0))
+	verboseMode  bool
+	master       string
+	token        string
+	tokenFile    string
+	caFile       string
+	certFile     string
+	keyFile      string
+	slave        string
+	slaveID      string
+	repository   string
+	script       string
+	runner       string
+	timeout      time.Duration
+	eventsPath   string
+	capture      uint
+	artifacts    stringList
+	artifactsDir = "cider-artifacts"
+	idemKey      string
+	retries      uint
+	retryBackoff = time.Second
+	jsonMode     bool
+	checkMode    bool
+	clean        bool
+	cloneDepth   uint
+	submodules   bool
+	envFile      string
+	env          = data.Env(make([]string, 0))
+	secrets      = data.Env(make([]string, 0))
 )
 
 var config = data.NewConfig()
 
+// tlsConfig is used to connect to the build master, nil means the defaults.
+var tlsConfig *tls.Config
+
+// console is where the build output and the progress messages are printed.
+// It is switched to stderr in the JSON mode, so that stdout only contains
+// the build result.
+var console io.Writer = os.Stdout
+
 var Command = &gocli.Command{
 	UsageLine: `
-  build [-verbose] [-master=URL] [-token=TOKEN] [-slave=SLAVE] [-runner=RUNNER]
-        [-repository=REPO] [-script=SCRIPT] [-env KEY=VALUE ...]`,
+  build [-verbose] [-master=URL] [-token=TOKEN|-token-file=FILE]
+        [-ca-file=FILE] [-cert-file=FILE -key-file=FILE]
+        [-slave=SLAVE|-slave-identity=IDENTITY] [-runner=RUNNER]
+        [-repository=REPO] [-script=SCRIPT] [-env-file=PATH] [-env KEY=VALUE ...]
+        [-env-secret KEY=BACKEND:REF ...] [-timeout=DURATION] [-clean]
+        [-clone-depth=N] [-submodules]
+        [-events=PATH] [-capture=BYTES]
+        [-artifact PATTERN ...] [-artifacts-dir=DIR]
+        [-idempotency-key=KEY] [-retries=N] [-retry-backoff=DURATION]
+        [-json] [-check]`,
 	Short: "trigger a build",
 	Long: `
   Trigger a build on the specified build slave.
@@ -45,6 +88,99 @@ var Command = &gocli.Command{
   located at REPO, and SCRIPT, which is a relative path to a script located
   within REPO. RUNNER program is used to run the script.
 
+  REPO is either a git+ssh, git+https or git+file URL with the branch to
+  build in the fragment, master by default, or an svn or svn+ssh URL of
+  the directory to check out with the revision in the fragment, HEAD by
+  default, e.g. svn+ssh://svn.example.com/project/trunk#1234.
+
+  Use -slave-identity instead of -slave to run the build on the slave with
+  the given identity, e.g. to reproduce a failure on the same machine.
+  The build fails right away when that slave is not connected.
+
+  The progress of cloning or pulling the repository is printed to stderr.
+  It is updated in place when stderr is a terminal, otherwise only the
+  finished checkout phases are printed.
+
+  The access token can be read from a file using -token-file so that it does
+  not appear in the process listing or in the shell history. The file must not
+  be accessible by other users.
+
+  The master certificate is verified against the system certificate pool
+  unless -ca-file is set, e.g. to the ca.crt file generated by cider setup.
+  The client certificate is presented to the master when -cert-file and
+  -key-file are set.
+
+  The environment variables can be read from a dotenv-style file using
+  -env-file. Every line is either KEY=VALUE, where VALUE can be quoted, or
+  a comment starting with #. The variables set using -env take precedence.
+
+  Secrets can be passed to the script using -env-secret. Only the reference
+  is sent, the value is looked up by the build slave, so the secret never
+  appears on the command line of the build client. The value is masked in the
+  build output. The build slave supports the following backends:
+
+    env:NAME  - environment variable CIDER_SECRET_NAME of the slave process
+    file:PATH - file located at PATH relative to the slave secrets directory
+
+  The script is terminated once it has been running for longer than DURATION.
+  When no DURATION is set, the build slave may apply a default timeout for
+  the runner. The build slave may limit the build duration as well, in which
+  case DURATION is cut down to the limit instead of the build being rejected.
+  The timeout applied and the slave limit exceeded, if any, are printed at
+  the beginning of the build output.
+
+  When -clean is set, the build slave removes the sources and clones the
+  repository again instead of pulling, so that no files are left behind by
+  the previous builds. This is slower, the whole repository is fetched.
+
+  When -clone-depth is set, the build slave clones and pulls only the last
+  N commits of the branch, which is faster for large repositories. The build
+  script cannot rely on the full history being available then.
+
+  When -submodules is set, the build slave checks out the git submodules,
+  recursively, every time the sources are cloned or pulled. The submodules
+  are left empty otherwise.
+
+  The build lifecycle events can be written to a Unix socket or a named pipe
+  located at PATH, one JSON object per line. The object type is one of
+  started, phase-changed and finished. The build is not affected when PATH
+  does not exist or the events cannot be written.
+
+  The files matching the -artifact glob patterns, relative to the repository
+  root, are sent back once the build succeeds and unpacked into DIR, which
+  defaults to cider-artifacts. The directories are sent recursively.
+
+  When -idempotency-key is set, the build slave that has already got a build
+  request with the same KEY returns the result of that build instead of
+  starting a new one. The output is streamed from the moment the request is
+  attached, in case the build is still running. The build slave keeps the
+  results for a limited time only, 10 minutes by default. KEY must be
+  printable ASCII without spaces, at most 128 characters, and it must not be
+  used for a different build.
+
+  When -retries is set, the build request is sent again up to N times when
+  the connection to the build master fails before any build output has been
+  received. The first retry happens after -retry-backoff, one second by
+  default, and the delay is doubled for every following retry. Combine this
+  with -idempotency-key to be sure that the build is not run twice.
+
+  When -capture is set, the build slave returns up to the last BYTES bytes of
+  the script stdout and stderr as part of the build result, separately.
+  The captured output is included in the finished event. The build slave
+  captures at most 1 MiB per stream.
+
+  When -json is set, the build output is printed to stderr and a single line
+  containing the build result as a JSON object is printed to stdout once
+  the build is finished, even when the build fails. The object contains
+  returnCode, error, slave and the durations in nanoseconds, including
+  totalDuration. returnCode is null when the build result is unknown, e.g.
+  because the connection to the build master was lost.
+
+  When -check is set, the configuration is only validated, the build master
+  is not contacted at all. The build method and the arguments that would be
+  sent are printed and the command exits with a non-zero status when
+  the configuration is not valid. This can be used to lint cider.yml.
+
   Example:
     $ cider build -master wss://cider.example.com:443/build -token=12345
                   -slave macosx -runner bash
@@ -57,6 +193,10 @@ var Command = &gocli.Command{
 
       CIDER_MASTER_URL
       CIDER_MASTER_TOKEN
+      CIDER_MASTER_TOKEN_FILE - file to read CIDER_MASTER_TOKEN from
+      CIDER_MASTER_CA_FILE
+      CIDER_MASTER_CERT_FILE
+      CIDER_MASTER_KEY_FILE
       CIDER_SLAVE_LABEL
       CIDER_REPOSITORY_URL
       CIDER_SCRIPT_PATH
@@ -69,13 +209,33 @@ var Command = &gocli.Command{
 func init() {
 	cmd := Command
 	cmd.Flags.BoolVar(&verboseMode, "verbose", verboseMode, "print more verbose output")
+	cmd.Flags.BoolVar(&jsonMode, "json", jsonMode, "print the build result to stdout as JSON")
+	cmd.Flags.BoolVar(&checkMode, "check", checkMode, "only validate the configuration and print the build request")
 	cmd.Flags.StringVar(&master, "master", master, "build master to connect to")
 	cmd.Flags.StringVar(&token, "token", token, "build master access token")
+	cmd.Flags.StringVar(&tokenFile, "token-file", tokenFile, "file to read the build master access token from")
+	cmd.Flags.StringVar(&caFile, "ca-file", caFile, "certificate authority to verify the build master with")
+	cmd.Flags.StringVar(&certFile, "cert-file", certFile, "client certificate to present to the build master")
+	cmd.Flags.StringVar(&keyFile, "key-file", keyFile, "client certificate key")
 	cmd.Flags.StringVar(&slave, "slave", slave, "slave label")
+	cmd.Flags.StringVar(&slaveID, "slave-identity", slaveID, "identity of the slave to run the build on")
 	cmd.Flags.StringVar(&runner, "runner", runner, "script runner")
 	cmd.Flags.StringVar(&repository, "repository", repository, "project repository URL")
 	cmd.Flags.StringVar(&script, "script", script, "relative path to the script to run")
+	cmd.Flags.StringVar(&envFile, "env-file", envFile, "read the environment variables from a file")
 	cmd.Flags.Var(&env, "env", "define an environment variable for the build run")
+	cmd.Flags.Var(&secrets, "env-secret", "define an environment variable resolved from a slave secret")
+	cmd.Flags.DurationVar(&timeout, "timeout", timeout, "build script timeout; 0 means no timeout")
+	cmd.Flags.BoolVar(&clean, "clean", clean, "clone the repository again instead of pulling")
+	cmd.Flags.UintVar(&cloneDepth, "clone-depth", cloneDepth, "number of commits to fetch; 0 means all")
+	cmd.Flags.BoolVar(&submodules, "submodules", submodules, "check out the git submodules")
+	cmd.Flags.StringVar(&eventsPath, "events", eventsPath, "Unix socket or named pipe to write the build events to")
+	cmd.Flags.UintVar(&capture, "capture", capture, "number of output bytes to return in the build result")
+	cmd.Flags.Var(&artifacts, "artifact", "glob pattern of the files to be sent back once the build succeeds")
+	cmd.Flags.StringVar(&artifactsDir, "artifacts-dir", artifactsDir, "directory to unpack the build artifacts into")
+	cmd.Flags.StringVar(&idemKey, "idempotency-key", idemKey, "key making the build request safe to retry")
+	cmd.Flags.UintVar(&retries, "retries", retries, "number of times the request is retried on connection errors")
+	cmd.Flags.DurationVar(&retryBackoff, "retry-backoff", retryBackoff, "delay before the first retry")
 }
 
 func triggerBuild(cmd *gocli.Command, argv []string) {
@@ -115,10 +275,32 @@ func triggerBuild(cmd *gocli.Command, argv []string) {
 	}
 	if token != "" {
 		config.Master.Token = token
+	} else if tokenFile != "" {
+		v, err := utils.ReadTokenFile(tokenFile)
+		if err != nil {
+			log.Fatalf("\nError: %v\n", err)
+		}
+		config.Master.Token = v
+	}
+	if caFile != "" {
+		config.Master.CAFile = caFile
+	}
+	if certFile != "" {
+		config.Master.CertFile = certFile
+	}
+	if keyFile != "" {
+		config.Master.KeyFile = keyFile
 	}
 	if slave != "" {
 		config.Slave.Label = slave
 	}
+	if slaveID != "" {
+		if slave != "" {
+			log.Fatalln("\nError: -slave and -slave-identity cannot be used together")
+		}
+		// The slaves export their methods for their identity as well.
+		config.Slave.Label = slaveID
+	}
 	if repository != "" {
 		config.Repository.URL = repository
 	}
@@ -129,9 +311,21 @@ func triggerBuild(cmd *gocli.Command, argv []string) {
 		config.Script.Runner = runner
 	}
 
+	if envFile != "" {
+		fileEnv, err := data.ReadEnvFile(envFile)
+		if err != nil {
+			log.Fatalf("\nError: %v\n", err)
+		}
+		for _, kv := range []string(fileEnv) {
+			config.Script.Env.Set(kv)
+		}
+	}
 	for _, kv := range []string(env) {
 		config.Script.Env.Set(kv)
 	}
+	for _, kv := range []string(secrets) {
+		config.Script.Secrets.Set(kv)
+	}
 
 	// Parse the RPC arguments. This performs some early arguments validation.
 	method, args, err := data.ParseArgs(config.Slave.Label, config.Repository.URL,
@@ -140,6 +334,26 @@ func triggerBuild(cmd *gocli.Command, argv []string) {
 		log.Fatalf("\nError: %v\n", err)
 	}
 
+	args.Secrets = config.Script.Secrets
+	args.Timeout = timeout
+	args.Capture = capture
+	args.Artifacts = artifacts
+	args.IdempotencyKey = idemKey
+	args.Clean = clean
+	args.CloneDepth = int(cloneDepth)
+	args.Submodules = submodules
+	if err := args.Validate(); err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// Print the build request and stop in the check mode.
+	if checkMode {
+		if err := printBuildRequest(os.Stdout, method, args); err != nil {
+			log.Fatalf("\nError: %v\n", err)
+		}
+		return
+	}
+
 	// Check that the build master config is complete as well.
 	switch {
 	case config.Master.URL == "":
@@ -148,8 +362,25 @@ func triggerBuild(cmd *gocli.Command, argv []string) {
 		log.Fatalln("\nError: build master access token is not set")
 	}
 
+	tlsConfig, err = utils.LoadTLSConfig(config.Master.CAFile, config.Master.CertFile, config.Master.KeyFile)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
 	// Send the build request and stream the output to the console.
-	result, err := call(config.Master.URL, config.Master.Token, method, args)
+	if jsonMode {
+		console = os.Stderr
+	}
+	result, code, err := call(config.Master.URL, config.Master.Token, method, args)
+	if jsonMode {
+		if ex := writeJSONResult(os.Stdout, result, code, err); ex != nil {
+			log.Fatalf("\nError: %v\n", ex)
+		}
+		if err != nil || result.Error != "" {
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		log.Fatalf("\nError: %v\n", err)
 	}
@@ -159,3 +390,25 @@ func triggerBuild(cmd *gocli.Command, argv []string) {
 		log.Fatalf("\nError: %v\n", result.Error)
 	}
 }
+
+// stringList is a flag.Value collecting all the values passed.
+type stringList []string
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+// printBuildRequest prints the build method and the build arguments.
+func printBuildRequest(w io.Writer, method string, args *data.BuildArgs) error {
+	content, err := json.MarshalIndent(args, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Method:    %v\nArguments: %s\n", method, content)
+	return err
+}
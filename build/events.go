@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package build
+
+import (
+	// Stdlib
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	// Cider
+	"github.com/cider/cider/data"
+)
+
+// Build event types.
+const (
+	EventStarted      = "started"
+	EventPhaseChanged = "phase-changed"
+	EventFinished     = "finished"
+)
+
+// Build phases reported by EventPhaseChanged.
+const (
+	PhaseConnecting   = "connecting"
+	PhaseSending      = "sending"
+	PhaseRunning      = "running"
+	PhaseInterrupting = "interrupting"
+)
+
+// Event is a build lifecycle event, encoded as a single line of JSON.
+type Event struct {
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	Method string            `json:"method,omitempty"`
+	Phase  string            `json:"phase,omitempty"`
+	Result *data.BuildResult `json:"result,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// EventSink writes build events to a Unix socket or a named pipe.
+//
+// The events are just informational, so the sink never fails the build.
+// Once writing an event fails, the sink silently drops all the following
+// events. All methods can be called on a nil sink, which drops all events.
+type EventSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+	mu  *sync.Mutex
+}
+
+// OpenEventSink connects to the Unix socket or opens the named pipe located
+// at path. Opening a named pipe fails unless there is a reader already.
+func OpenEventSink(path string) (*EventSink, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.WriteCloser
+	if info.Mode()&os.ModeSocket != 0 {
+		w, err = net.Dial("unix", path)
+	} else {
+		w, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &EventSink{w, json.NewEncoder(w), new(sync.Mutex)}, nil
+}
+
+// Emit writes the event, filling in the event time.
+func (sink *EventSink) Emit(event *Event) {
+	if sink == nil {
+		return
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.enc == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	if err := sink.enc.Encode(event); err != nil {
+		verbose("@{c}>>>@{|} Failed to emit a build event: ", err, "\n")
+		sink.enc = nil
+	}
+}
+
+func (sink *EventSink) Phase(method, phase string) {
+	sink.Emit(&Event{Type: EventPhaseChanged, Method: method, Phase: phase})
+}
+
+func (sink *EventSink) Close() error {
+	if sink == nil {
+		return nil
+	}
+	return sink.w.Close()
+}
+
+// phaseWriter emits PhaseRunning on the first write.
+type phaseWriter struct {
+	w      io.Writer
+	once   *sync.Once
+	events *EventSink
+	method string
+}
+
+func (pw *phaseWriter) Write(p []byte) (int, error) {
+	pw.once.Do(func() {
+		pw.events.Phase(pw.method, PhaseRunning)
+	})
+	return pw.w.Write(p)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package build
+
+import (
+	// Stdlib
+	"encoding/json"
+	"io"
+	"time"
+
+	// Cider
+	"github.com/cider/cider/data"
+
+	// Meeko
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+)
+
+// jsonResult is printed as a single line once the build is finished when
+// the JSON output is requested. ReturnCode is null when the build request
+// was not resolved, e.g. because the connection was lost.
+type jsonResult struct {
+	ReturnCode    *rpc.ReturnCode `json:"returnCode"`
+	Error         string          `json:"error"`
+	TotalDuration time.Duration   `json:"totalDuration"`
+	*data.BuildResult
+}
+
+func writeJSONResult(w io.Writer, result *data.BuildResult, code rpc.ReturnCode, err error) error {
+	out := &jsonResult{BuildResult: result}
+	switch err := err.(type) {
+	case nil:
+		out.ReturnCode = &code
+		out.Error = result.Error
+		out.TotalDuration = result.PullDuration + result.BuildDuration
+	case *ErrRejected:
+		out.ReturnCode = &err.Code
+		out.Error = err.Error()
+	default:
+		out.Error = err.Error()
+	}
+	return json.NewEncoder(w).Encode(out)
+}
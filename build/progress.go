@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package build
+
+import (
+	// Stdlib
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	// Cider
+	"github.com/cider/cider/data"
+)
+
+// controlPrefix starts all the control lines the build slaves insert into
+// the build output, e.g. the progress lines.
+const controlPrefix = "::cider:"
+
+// controlFilter passes the build output on while removing the control lines
+// that are consumed by the handler. The handler returns false for the lines
+// it does not recognise, these are passed on as well.
+type controlFilter struct {
+	w       io.Writer
+	handle  func(line string) bool
+	line    []byte
+	passing bool
+}
+
+func newControlFilter(w io.Writer, handle func(line string) bool) *controlFilter {
+	return &controlFilter{w: w, handle: handle}
+}
+
+// newProgressFilter returns a control filter rendering the progress lines.
+func newProgressFilter(w io.Writer, render func(*data.Progress)) *controlFilter {
+	return newControlFilter(w, func(line string) bool {
+		progress := data.ParseProgress(line)
+		if progress == nil {
+			return false
+		}
+		render(progress)
+		return true
+	})
+}
+
+// FilterProgress returns a writer passing the build output on to w while
+// rendering the progress lines into progress, the same way the build command
+// does. flush must be called once the output is complete.
+func FilterProgress(w io.Writer, progress *os.File) (filtered io.Writer, flush func() error) {
+	filter := newProgressFilter(w, newProgressRenderer(progress))
+	return filter, filter.Flush
+}
+
+func (filter *controlFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	prefix := []byte(controlPrefix)
+	for len(p) != 0 {
+		// Pass the rest of a regular line on as it is.
+		if filter.passing {
+			i := bytes.IndexByte(p, '\n')
+			if i == -1 {
+				_, err := filter.w.Write(p)
+				return n, err
+			}
+			if _, err := filter.w.Write(p[:i+1]); err != nil {
+				return n, err
+			}
+			filter.passing = false
+			p = p[i+1:]
+			continue
+		}
+
+		// Collect the line until it is clear whether it is a control line.
+		b := p[0]
+		p = p[1:]
+		filter.line = append(filter.line, b)
+		switch {
+		case len(filter.line) <= len(prefix) && !bytes.HasPrefix(prefix, filter.line):
+			filter.passing = b != '\n'
+			if err := filter.flushLine(); err != nil {
+				return n, err
+			}
+		case b == '\n':
+			if filter.handle(string(filter.line)) {
+				filter.line = filter.line[:0]
+			} else if err := filter.flushLine(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes out the unterminated line that is being collected, if any.
+func (filter *controlFilter) Flush() error {
+	return filter.flushLine()
+}
+
+func (filter *controlFilter) flushLine() error {
+	if len(filter.line) == 0 {
+		return nil
+	}
+	_, err := filter.w.Write(filter.line)
+	filter.line = filter.line[:0]
+	return err
+}
+
+// newProgressRenderer returns a function printing the progress into w.
+// The progress line is updated in place when w is a terminal, otherwise only
+// the finished phases are printed so that the build logs stay readable.
+func newProgressRenderer(w *os.File) func(*data.Progress) {
+	interactive := false
+	if info, err := w.Stat(); err == nil {
+		interactive = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	return func(progress *data.Progress) {
+		switch {
+		case interactive && progress.Percent == 100:
+			fmt.Fprintf(w, "\r---> Checkout: %v %3d%%\n", progress.Phase, progress.Percent)
+		case interactive:
+			fmt.Fprintf(w, "\r---> Checkout: %v %3d%%", progress.Phase, progress.Percent)
+		case progress.Percent == 100:
+			fmt.Fprintf(w, "---> Checkout: %v done\n", progress.Phase)
+		}
+	}
+}
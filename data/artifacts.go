@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package data
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ArtifactsPrefix starts the lines carrying the build artifacts in the build
+// output. The artifacts are sent as a gzipped tarball split into frames:
+//
+//	::cider:artifacts:TAG:data:BASE64
+//	::cider:artifacts:TAG:end:
+//	::cider:artifacts:TAG:error:MESSAGE
+//
+// TAG is BuildArgs.ArtifactsTag. It is chosen by the client and it is not
+// exported for the build script, so the script cannot forge the frames.
+const ArtifactsPrefix = "::cider:artifacts:"
+
+// Artifact frame kinds.
+const (
+	ArtifactsData  = "data"
+	ArtifactsEnd   = "end"
+	ArtifactsError = "error"
+)
+
+// FormatArtifactsFrame returns the frame line, including the trailing newline.
+// The payload is base64-encoded for data frames.
+func FormatArtifactsFrame(tag, kind string, payload []byte) string {
+	if kind == ArtifactsData {
+		return ArtifactsPrefix + tag + ":" + kind + ":" + base64.StdEncoding.EncodeToString(payload) + "\n"
+	}
+	return ArtifactsPrefix + tag + ":" + kind + ":" + strings.Replace(string(payload), "\n", " ", -1) + "\n"
+}
+
+// ParseArtifactsFrame parses a frame line carrying the given tag. ok is false
+// in case the line is not such a frame at all.
+func ParseArtifactsFrame(line, tag string) (kind string, payload []byte, ok bool, err error) {
+	line = strings.TrimRight(line, "\r\n")
+	prefix := ArtifactsPrefix + tag + ":"
+	if !strings.HasPrefix(line, prefix) {
+		return "", nil, false, nil
+	}
+
+	parts := strings.SplitN(line[len(prefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", nil, true, fmt.Errorf("invalid artifacts frame: %v", line)
+	}
+	kind = parts[0]
+	switch kind {
+	case ArtifactsData:
+		payload, err = base64.StdEncoding.DecodeString(parts[1])
+	case ArtifactsEnd, ArtifactsError:
+		payload = []byte(parts[1])
+	default:
+		err = fmt.Errorf("unknown artifacts frame kind: %v", kind)
+	}
+	return kind, payload, true, err
+}
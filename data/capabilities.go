@@ -0,0 +1,16 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package data
+
+// Capabilities describes the methods registered by a build slave.
+// The build slaves return it from the cider.LABEL.capabilities methods.
+type Capabilities struct {
+	Slave     string   `codec:"slave" json:"slave"`
+	Labels    []string `codec:"labels" json:"labels"`
+	Runners   []string `codec:"runners" json:"runners"`
+	Workspace string   `codec:"workspace" json:"workspace"`
+	Executors uint     `codec:"executors" json:"executors"`
+}
@@ -10,6 +10,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/cider/cider/utils"
+
 	"gopkg.in/yaml.v1"
 )
 
@@ -30,7 +32,7 @@ func (env *Env) Set(kv string) error {
 	for i, kw := range *slice {
 		ps := strings.SplitN(kw, "=", 2)
 		if ps[0] == parts[0] {
-			*slice = append((*slice)[:i], (*slice)[i+i:]...)
+			*slice = append((*slice)[:i], (*slice)[i+1:]...)
 			break
 		}
 	}
@@ -48,6 +50,11 @@ type Config struct {
 	Master struct {
 		URL   string `yaml:"url"`
 		Token string `yaml:"token"`
+
+		// The TLS settings, see utils.LoadTLSConfig.
+		CAFile   string `yaml:"ca_file"`
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
 	} `yaml:"master"`
 	Slave struct {
 		Label string `yaml:"label"`
@@ -56,15 +63,17 @@ type Config struct {
 		URL string `yaml:"url"`
 	} `yaml:"repository"`
 	Script struct {
-		Path   string `yaml:"path"`
-		Runner string `yaml:"runner"`
-		Env    Env    `yaml:"env"`
+		Path    string `yaml:"path"`
+		Runner  string `yaml:"runner"`
+		Env     Env    `yaml:"env"`
+		Secrets Env    `yaml:"secrets"`
 	} `yaml:"script"`
 }
 
 func NewConfig() *Config {
 	var config Config
 	config.Script.Env = make([]string, 0)
+	config.Script.Secrets = make([]string, 0)
 	return &config
 }
 
@@ -83,6 +92,21 @@ func (config *Config) FeedFromEnv(prefix string) error {
 	}
 	if v := os.Getenv(prefix + "_MASTER_TOKEN"); v != "" {
 		config.Master.Token = v
+	} else if v := os.Getenv(prefix + "_MASTER_TOKEN_FILE"); v != "" {
+		token, err := utils.ReadTokenFile(v)
+		if err != nil {
+			return err
+		}
+		config.Master.Token = token
+	}
+	if v := os.Getenv(prefix + "_MASTER_CA_FILE"); v != "" {
+		config.Master.CAFile = v
+	}
+	if v := os.Getenv(prefix + "_MASTER_CERT_FILE"); v != "" {
+		config.Master.CertFile = v
+	}
+	if v := os.Getenv(prefix + "_MASTER_KEY_FILE"); v != "" {
+		config.Master.KeyFile = v
 	}
 	if v := os.Getenv(prefix + "_SLAVE_LABEL"); v != "" {
 		config.Slave.Label = v
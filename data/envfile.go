@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ReadEnvFile reads the dotenv-style file located at path and returns
+// the variables defined, in the order they appear in the file.
+//
+// Every line is either empty, a comment starting with #, or KEY=VALUE,
+// optionally prefixed with export. VALUE can be quoted using single quotes,
+// in which case it is taken literally, or double quotes, in which case
+// \", \\ and \n are unescaped.
+func ReadEnvFile(path string) (Env, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env := Env(make([]string, 0))
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("env file %v, line %v: %v", path, n, err)
+		}
+		env.Set(kv)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("env file %v: %v", path, err)
+	}
+	return env, nil
+}
+
+func parseEnvLine(line string) (string, error) {
+	if strings.HasPrefix(line, "export ") {
+		line = strings.TrimSpace(line[len("export "):])
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid key-value pair: %v", line)
+	}
+	key := strings.TrimSpace(parts[0])
+	if key == "" || strings.ContainsAny(key, " \t\"'") {
+		return "", fmt.Errorf("invalid variable name: %q", key)
+	}
+
+	value := strings.TrimSpace(parts[1])
+	if value == "" {
+		return key + "=", nil
+	}
+
+	var rest string
+	switch quote := value[0]; quote {
+	case '\'':
+		end := strings.IndexByte(value[1:], quote)
+		if end == -1 {
+			return "", fmt.Errorf("unterminated quoted value: %v", value)
+		}
+		value, rest = value[1:end+1], value[end+2:]
+	case '"':
+		var buf bytes.Buffer
+		i := 1
+	Unquote:
+		for ; i < len(value); i++ {
+			switch c := value[i]; c {
+			case '"':
+				break Unquote
+			case '\\':
+				if i+1 == len(value) {
+					break Unquote
+				}
+				i++
+				switch value[i] {
+				case 'n':
+					buf.WriteByte('\n')
+				case '"', '\\':
+					buf.WriteByte(value[i])
+				default:
+					buf.WriteByte('\\')
+					buf.WriteByte(value[i])
+				}
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		if i >= len(value) || value[i] != '"' {
+			return "", fmt.Errorf("unterminated quoted value: %v", value)
+		}
+		value, rest = buf.String(), value[i+1:]
+	default:
+		return key + "=" + value, nil
+	}
+
+	// Only a comment can follow the closing quote.
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected characters after quoted value: %v", rest)
+	}
+	return key + "=" + value, nil
+}
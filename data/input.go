@@ -9,9 +9,19 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"path"
+	"reflect"
+	"regexp"
 	"strings"
+	"time"
+
+	"github.com/cider/cider/utils/archive"
+	"github.com/cider/cider/vcs"
 )
 
+// ParseArgs assembles the build method name and the build arguments.
+// slave is either a slave label or a slave identity, since the build slaves
+// export their methods for their identity as well. It defaults to any.
 func ParseArgs(slave, repository, script, runner string, env []string) (method string, args *BuildArgs, err error) {
 	// Make sure that the arguments are not empty.
 	var unset string
@@ -44,11 +54,45 @@ func ParseArgs(slave, repository, script, runner string, env []string) (method s
 	return
 }
 
+// artifactsTagRegexp matches the valid BuildArgs.ArtifactsTag values.
+var artifactsTagRegexp = regexp.MustCompile(`^[A-Za-z0-9]{16,}$`)
+
+// idempotencyKeyRegexp matches the valid BuildArgs.IdempotencyKey values.
+var idempotencyKeyRegexp = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+
 type BuildArgs struct {
-	Repository string   `codec:"repository"`
-	Script     string   `codec:"script"`
-	Env        []string `codec:"env,omitempty"`
-	Noop       bool     `codec:"noop,omitempty"` // For benchmarking purposes only.
+	Repository string        `codec:"repository" json:"repository"`
+	Script     string        `codec:"script" json:"script"`
+	Env        []string      `codec:"env,omitempty" json:"env,omitempty"`
+	Secrets    []string      `codec:"secrets,omitempty" json:"secrets,omitempty"`
+	Timeout    time.Duration `codec:"timeout,omitempty" json:"timeout,omitempty"`
+	Capture    uint          `codec:"capture,omitempty" json:"capture,omitempty"`
+
+	// Artifacts are glob patterns relative to SRCDIR. The matching files are
+	// sent back in the build output once the build succeeds, marked using
+	// ArtifactsTag. Nothing is sent unless ArtifactsTag is set.
+	// See ArtifactsPrefix.
+	Artifacts    []string `codec:"artifacts,omitempty" json:"artifacts,omitempty"`
+	ArtifactsTag string   `codec:"artifactsTag,omitempty" json:"artifactsTag,omitempty"`
+
+	// IdempotencyKey makes the slave return the result of the build started
+	// with the same key instead of starting a new build, so that the request
+	// can be safely retried. The key must be used for the same build only.
+	IdempotencyKey string `codec:"idempotencyKey,omitempty" json:"idempotencyKey,omitempty"`
+
+	// Clean makes the slave remove the sources and clone the repository
+	// again instead of pulling into the existing sources.
+	Clean bool `codec:"clean,omitempty" json:"clean,omitempty"`
+
+	// CloneDepth makes the slave clone and pull only the given number of
+	// commits. Zero means the full history.
+	CloneDepth int `codec:"cloneDepth,omitempty" json:"cloneDepth,omitempty"`
+
+	// Submodules makes the slave check out the git submodules, recursively,
+	// after the sources are cloned or pulled.
+	Submodules bool `codec:"submodules,omitempty" json:"submodules,omitempty"`
+
+	Noop bool `codec:"noop,omitempty" json:"noop,omitempty"` // For benchmarking purposes only.
 }
 
 func (args *BuildArgs) Validate() error {
@@ -57,6 +101,10 @@ func (args *BuildArgs) Validate() error {
 		return errors.New("BuildArgs.Validate: Repository is not set")
 	case args.Script == "":
 		return errors.New("BuildArgs.Validate: Script is not set")
+	case args.Timeout < 0:
+		return errors.New("BuildArgs.Validate: Timeout is negative")
+	case args.CloneDepth < 0:
+		return errors.New("BuildArgs.Validate: CloneDepth is negative")
 	}
 
 	repoURL, err := url.Parse(args.Repository)
@@ -64,13 +112,10 @@ func (args *BuildArgs) Validate() error {
 		return fmt.Errorf("BuildArgs.Validate: %v", err)
 	}
 
-	switch repoURL.Scheme {
-	case "git+https":
-	case "git+ssh":
-	case "git+file":
-	default:
-		return fmt.Errorf("BuildArgs.Validate: unsupported repository URL scheme: %v",
-			repoURL.Scheme)
+	// The scheme is checked here so that a typo is reported by the client.
+	if vcs.Kind(repoURL.Scheme) == "" {
+		return fmt.Errorf("BuildArgs.Validate: unsupported repository URL scheme: %q (supported: %v)",
+			repoURL.Scheme, strings.Join(vcs.SupportedSchemes(), ", "))
 	}
 
 	for _, kv := range args.Env {
@@ -79,9 +124,52 @@ func (args *BuildArgs) Validate() error {
 		}
 	}
 
+	if args.ArtifactsTag != "" && !artifactsTagRegexp.MatchString(args.ArtifactsTag) {
+		return errors.New("BuildArgs.Validate: ArtifactsTag is not a valid tag")
+	}
+	if args.IdempotencyKey != "" && !idempotencyKeyRegexp.MatchString(args.IdempotencyKey) {
+		return errors.New("BuildArgs.Validate: IdempotencyKey is not a valid key")
+	}
+	for _, pattern := range args.Artifacts {
+		if err := archive.ValidatePath(pattern); err != nil {
+			return fmt.Errorf("BuildArgs.Validate: invalid artifacts pattern: %v", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("BuildArgs.Validate: invalid artifacts pattern: %v", pattern)
+		}
+	}
+
+	// Secrets are KEY=BACKEND:REF pairs, the values are resolved by the slave.
+	for _, kv := range args.Secrets {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.Contains(parts[1], ":") {
+			return &ErrInvalidEnvironment{kv}
+		}
+	}
+
 	return nil
 }
 
+// UnknownArgs returns the keys that do not correspond to any BuildArgs field.
+// These are ignored when decoding, which usually means that the arguments
+// were sent by a newer client.
+func UnknownArgs(keys []string) []string {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(BuildArgs{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.SplitN(t.Field(i).Tag.Get("codec"), ",", 2)[0]
+		known[name] = true
+	}
+
+	var unknown []string
+	for _, key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	return unknown
+}
+
 type ErrInvalidEnvironment struct {
 	kv string
 }
@@ -14,9 +14,26 @@ import (
 )
 
 type BuildResult struct {
-	PullDuration  time.Duration `codec:"pullDuration"`
-	BuildDuration time.Duration `codec:"buildDuration"`
-	Error         string        `codec:"error"`
+	Slave         string        `codec:"slave,omitempty" json:"slave,omitempty"`
+	PullDuration  time.Duration `codec:"pullDuration" json:"pullDuration"`
+	BuildDuration time.Duration `codec:"buildDuration" json:"buildDuration"`
+	Error         string        `codec:"error" json:"error"`
+
+	// QueueDuration is the time the build spent waiting for the workspace
+	// lock and a free executor, so it tells an overloaded slave from a slow
+	// build. It is not included in the total duration.
+	QueueDuration time.Duration `codec:"queueDuration,omitempty" json:"queueDuration,omitempty"`
+
+	// UserTime and SystemTime is the CPU time consumed by the build script.
+	// These are zero when the script was not run or the slave platform does
+	// not provide the information.
+	UserTime   time.Duration `codec:"userTime,omitempty" json:"userTime,omitempty"`
+	SystemTime time.Duration `codec:"systemTime,omitempty" json:"systemTime,omitempty"`
+
+	// Stdout and Stderr contain the tail of the script output when
+	// requested using BuildArgs.Capture.
+	Stdout string `codec:"stdout,omitempty" json:"stdout,omitempty"`
+	Stderr string `codec:"stderr,omitempty" json:"stderr,omitempty"`
 }
 
 func (result BuildResult) WriteSummary(w io.Writer) {
@@ -26,8 +43,9 @@ func (result BuildResult) WriteSummary(w io.Writer) {
 		totalStr = total.String()
 		pullStr  = result.PullDuration.String()
 		buildStr = result.BuildDuration.String()
+		queueStr = result.QueueDuration.String()
 
-		all = [...]*string{&pullStr, &buildStr, &totalStr}
+		all = [...]*string{&pullStr, &buildStr, &totalStr, &queueStr}
 
 		maxDotIndex    int
 		maxFragmentLen int
@@ -61,4 +79,10 @@ func (result BuildResult) WriteSummary(w io.Writer) {
 	fmt.Fprintf(w, "Pull  duration: %v\n", *all[0])
 	fmt.Fprintf(w, "Build duration: %v\n", *all[1])
 	fmt.Fprintf(w, "Total duration: %v\n", *all[2])
+	if result.QueueDuration != 0 {
+		fmt.Fprintf(w, "Queue duration: %v\n", *all[3])
+	}
+	if result.UserTime != 0 || result.SystemTime != 0 {
+		fmt.Fprintf(w, "CPU time:       %v user, %v system\n", result.UserTime, result.SystemTime)
+	}
 }
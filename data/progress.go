@@ -0,0 +1,50 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProgressPrefix starts the progress lines the build slaves insert into
+// the build output. A progress line looks like
+//
+//	::cider:progress:PHASE:PERCENT
+//
+// The build client turns these into a progress indicator.
+const ProgressPrefix = "::cider:progress:"
+
+type Progress struct {
+	Phase   string
+	Percent int
+}
+
+// String returns the progress line, including the trailing newline.
+func (p *Progress) String() string {
+	return fmt.Sprintf("%v%v:%v\n", ProgressPrefix, p.Phase, p.Percent)
+}
+
+// ParseProgress parses a progress line. It returns nil in case the line is
+// not a valid progress line.
+func ParseProgress(line string) *Progress {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, ProgressPrefix) {
+		return nil
+	}
+	line = line[len(ProgressPrefix):]
+
+	i := strings.LastIndex(line, ":")
+	if i == -1 {
+		return nil
+	}
+	percent, err := strconv.Atoi(line[i+1:])
+	if err != nil || percent < 0 || percent > 100 {
+		return nil
+	}
+	return &Progress{line[:i], percent}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"github.com/cider/cider/build"
+	"github.com/cider/cider/setup"
 	"github.com/cider/cider/slave"
 
 	"github.com/tchap/gocli"
@@ -39,6 +40,9 @@ func main() {
 
 	cider.MustRegisterSubcommand(build.Command)
 	cider.MustRegisterSubcommand(slave.Command)
+	cider.MustRegisterSubcommand(slave.RunnersCommand)
+	cider.MustRegisterSubcommand(slave.RunCommand)
+	cider.MustRegisterSubcommand(setup.Command)
 
 	cider.Run(os.Args[1:])
 }
@@ -0,0 +1,161 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package setup
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	keySize      = 2048
+	certValidFor = 365 * 24 * time.Hour
+	organization = "Cider (self-signed, not for production use)"
+)
+
+type certificate struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newAuthority() (*certificate, error) {
+	template, err := newTemplate("Cider CA")
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+
+	return newCertificate(template, nil)
+}
+
+// hostnameRegexp matches the valid DNS names, wildcards included.
+var hostnameRegexp = regexp.MustCompile(
+	`^(\*\.)?[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// parseHosts splits the comma-separated list of host names and IP addresses.
+// The empty items are skipped, but there must be at least one host.
+func parseHosts(list string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		host = strings.TrimSpace(host)
+		switch {
+		case host == "":
+			continue
+		case net.ParseIP(host) == nil && !hostnameRegexp.MatchString(host):
+			return nil, fmt.Errorf("invalid host name: %q", host)
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no host to generate the certificate for")
+	}
+	return hosts, nil
+}
+
+// newServerCertificate generates the master certificate, valid for hosts.
+// The hosts are expected to be validated using parseHosts.
+func (ca *certificate) newServerCertificate(hosts []string) (*certificate, error) {
+	template, err := newTemplate(hosts[0])
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return newCertificate(template, ca)
+}
+
+// newClientCertificate generates a certificate the clients and the slaves
+// can use to authenticate against the master.
+func (ca *certificate) newClientCertificate(commonName string) (*certificate, error) {
+	template, err := newTemplate(commonName)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return newCertificate(template, ca)
+}
+
+func newTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{organization},
+			CommonName:   commonName,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(certValidFor),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// newCertificate generates a new key and signs the certificate using parent.
+// The certificate is self-signed in case parent is nil.
+func newCertificate(template *x509.Certificate, parent *certificate) (*certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		parentCert = template
+		parentKey  = key
+	)
+	if parent != nil {
+		parentCert = parent.cert
+		parentKey = parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certificate{
+		cert: cert,
+		key:  key,
+		certPEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: der,
+		}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}),
+	}, nil
+}
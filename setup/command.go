@@ -0,0 +1,274 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package setup
+
+import (
+	// Stdlib
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	// Cider
+	"github.com/cider/cider/data"
+
+	// Others
+	"github.com/tchap/gocli"
+)
+
+const (
+	MasterConfigFileName = "master.yml"
+	MasterEnvFileName    = "master.env"
+	TokenFileName        = "token"
+)
+
+var (
+	dir     = "."
+	address = "localhost:443"
+	hosts   string
+	force   bool
+)
+
+var Command = &gocli.Command{
+	UsageLine: `
+  setup [-dir=DIR] [-address=ADDRESS] [-hosts=HOSTS] [-force]`,
+	Short: "generate TLS certificates and tokens",
+	Long: `
+  Generate everything that is needed to run a secured Cider deployment.
+
+  The following files are written into DIR:
+
+    ca.crt, ca.key         - self-signed certificate authority
+    master.crt, master.key - master certificate signed by the CA
+    client.crt, client.key - client certificate signed by the CA
+    token                  - random master access token
+    master.yml             - master (meekod) configuration
+    master.env             - master (meekod) environment enabling TLS
+    cider.yml              - starter project configuration
+
+  The master certificate is valid for HOSTS, which is a comma-separated list
+  of host names and IP addresses. It defaults to the host part of ADDRESS,
+  which is the network address the master is going to listen on.
+
+  meekod reads the TLS settings from the environment, so master.env must be
+  loaded into the environment of meekod, e.g. using set -a; . ./master.env.
+
+  The certificate authority is self-signed, so the clients and the slaves must
+  be configured to trust ca.crt using -ca-file or CIDER_MASTER_CA_FILE.
+  The client certificate can be passed to them using -cert-file and -key-file.
+  This is fine for testing and small private deployments, but it is NOT meant
+  for production use.
+
+  The access token is not written into cider.yml since that file is usually
+  committed into the project repository. Use CIDER_MASTER_TOKEN instead.
+
+  Existing files are never overwritten unless -force is specified.
+	`,
+	Action: setup,
+}
+
+func init() {
+	cmd := Command
+	cmd.Flags.StringVar(&dir, "dir", dir, "directory to write the files into")
+	cmd.Flags.StringVar(&address, "address", address, "network address of the master")
+	cmd.Flags.StringVar(&hosts, "hosts", hosts, "host names and IPs to generate the certificate for")
+	cmd.Flags.BoolVar(&force, "force", force, "overwrite existing files")
+}
+
+func setup(cmd *gocli.Command, argv []string) {
+	// Make sure there were no arguments specified.
+	if len(argv) != 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	// Disable all the log prefixes and what not.
+	log.SetFlags(0)
+
+	// Work out the hosts to generate the certificate for.
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Fatalf("\nError: invalid address: %v\n", err)
+	}
+	if hosts == "" {
+		hosts = host
+	}
+	hostList, err := parseHosts(hosts)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// The paths in master.env must not depend on the working directory.
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// Generate the certificates.
+	fmt.Println("---> Generating the certificate authority")
+	ca, err := newAuthority()
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	fmt.Println("---> Generating the master certificate")
+	cert, err := ca.newServerCertificate(hostList)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	fmt.Println("---> Generating the client certificate")
+	clientCert, err := ca.newClientCertificate("Cider client")
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// Generate the master token.
+	fmt.Println("---> Generating the master access token")
+	token, err := randomToken()
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// Generate the configuration files.
+	masterConfig, err := render(masterConfigTemplate, address, token, absDir)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+	masterEnv, err := render(masterEnvTemplate, address, token, absDir)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+	projectConfig, err := render(projectConfigTemplate, address, token, absDir)
+	if err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	// Write everything to the disk.
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Fatalf("\nError: %v\n", err)
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{"ca.crt", ca.certPEM, 0644},
+		{"ca.key", ca.keyPEM, 0600},
+		{"master.crt", cert.certPEM, 0644},
+		{"master.key", cert.keyPEM, 0600},
+		{"client.crt", clientCert.certPEM, 0644},
+		{"client.key", clientCert.keyPEM, 0600},
+		{TokenFileName, []byte(token + "\n"), 0600},
+		{MasterConfigFileName, masterConfig, 0600},
+		{MasterEnvFileName, masterEnv, 0644},
+		{data.ConfigFileName, projectConfig, 0644},
+	}
+	if !force {
+		for _, file := range files {
+			path := filepath.Join(dir, file.name)
+			if _, err := os.Stat(path); err == nil {
+				log.Fatalf("\nError: file already exists: %v\n", path)
+			}
+		}
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		fmt.Printf("---> Writing %v\n", path)
+		if err := writeFile(path, file.content, file.mode); err != nil {
+			log.Fatalf("\nError: %v\n", err)
+		}
+	}
+
+	fmt.Printf(`
+---> Start the master with TLS enabled:
+
+       set -a; . %v; set +a
+       meekod -config %v
+
+---> Configure the clients and the slaves to trust the master:
+
+       export CIDER_MASTER_CA_FILE=%v
+       export CIDER_MASTER_CERT_FILE=%v
+       export CIDER_MASTER_KEY_FILE=%v
+`,
+		filepath.Join(absDir, MasterEnvFileName),
+		filepath.Join(absDir, MasterConfigFileName),
+		filepath.Join(absDir, "ca.crt"),
+		filepath.Join(absDir, "client.crt"),
+		filepath.Join(absDir, "client.key"))
+
+	fmt.Println("\n---> The certificates are self-signed, do NOT use them in production")
+}
+
+func writeFile(path string, content []byte, mode os.FileMode) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	file, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+const masterConfigTemplate = `broker:
+  endpoints:
+    rpc:
+      websocket:
+        address: "{{.Address}}"
+        token:   "{{.Token}}"
+`
+
+// masterEnvTemplate enables TLS for the meekod WebSocket RPC endpoint.
+// The TLS settings cannot be set in master.yml.
+const masterEnvTemplate = `MEEKO_WEBSOCKET_RPC_TLS_CERT="{{.Dir}}/master.crt"
+MEEKO_WEBSOCKET_RPC_TLS_KEY="{{.Dir}}/master.key"
+`
+
+const projectConfigTemplate = `master:
+  url: "wss://{{.Address}}/connect"
+  # Do not commit the access token, use CIDER_MASTER_TOKEN instead.
+  # The certificate authority generated by cider setup must be trusted,
+  # use CIDER_MASTER_CA_FILE or uncomment the following line.
+  # ca_file: "{{.Dir}}/ca.crt"
+`
+
+func render(text, address, token, dir string) ([]byte, error) {
+	ctx := struct {
+		Address string
+		Token   string
+		Dir     string
+	}{
+		address,
+		token,
+		filepath.ToSlash(dir),
+	}
+
+	var out bytes.Buffer
+	err := template.Must(template.New("config").Parse(text)).Execute(&out, ctx)
+	return out.Bytes(), err
+}
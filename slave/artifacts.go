@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	// Cider
+	"github.com/cider/cider/data"
+	"github.com/cider/cider/utils/archive"
+)
+
+// maxFrameSize is the maximum number of bytes carried by an artifacts frame,
+// before being base64-encoded.
+const maxFrameSize = 24 * 1024
+
+// frameWriter splits the data written into artifacts data frames.
+type frameWriter struct {
+	w   io.Writer
+	tag string
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		size := len(p)
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		frame := data.FormatArtifactsFrame(fw.tag, data.ArtifactsData, p[:size])
+		if _, err := io.WriteString(fw.w, frame); err != nil {
+			return n - len(p), err
+		}
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// sendArtifacts streams the files matching the artifacts patterns into frames,
+// which is supposed to be the request stdout, but not mirrored anywhere else.
+// The archive is generated on the fly, it is never kept in memory as a whole.
+func sendArtifacts(args *data.BuildArgs, srcDir string, frames, stdout, stderr io.Writer) {
+	paths, err := globArtifacts(srcDir, args.Artifacts)
+	if err == nil {
+		fmt.Fprintf(stdout, "\n---> Sending %v artifact(s)\n", len(paths))
+		err = archive.Pack(&frameWriter{frames, args.ArtifactsTag}, srcDir, paths)
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "---> Failed to send the artifacts: %v\n", err)
+		io.WriteString(frames, data.FormatArtifactsFrame(
+			args.ArtifactsTag, data.ArtifactsError, []byte(err.Error())))
+		return
+	}
+	io.WriteString(frames, data.FormatArtifactsFrame(args.ArtifactsTag, data.ArtifactsEnd, nil))
+}
+
+// globArtifacts returns the paths relative to srcDir matching the patterns.
+func globArtifacts(srcDir string, patterns []string) ([]string, error) {
+	var (
+		paths []string
+		seen  = make(map[string]bool)
+	)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(srcDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			path, err := filepath.Rel(srcDir, match)
+			if err != nil {
+				return nil, err
+			}
+			if archive.ValidatePath(path) != nil {
+				return nil, errors.New("artifacts pattern matches paths outside of SRCDIR")
+			}
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
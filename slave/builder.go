@@ -7,80 +7,180 @@ package slave
 
 import (
 	// Stdlib
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	// Cider
 	"github.com/cider/cider/data"
+	"github.com/cider/cider/slave/cache"
+	"github.com/cider/cider/slave/charset"
 	"github.com/cider/cider/slave/runners"
+	"github.com/cider/cider/slave/secrets"
+	"github.com/cider/cider/utils/executil"
+	"github.com/cider/cider/vcs"
 
 	// Meeko
 	"github.com/meeko/go-meeko/meeko/services/rpc"
-	"github.com/meeko/meekod/supervisor/utils/executil"
-	"github.com/meeko/meekod/supervisor/utils/vcsutil"
 )
 
 type Builder struct {
-	runner    *runners.Runner
-	manager   *WorkspaceManager
-	execQueue chan bool
+	identity       string
+	runner         *runners.Runner
+	manager        *WorkspaceManager
+	execQueue      chan bool
+	vcsQueue       chan bool
+	secrets        *secrets.Store
+	outputCharset  string
+	inheritAllEnv  bool
+	inheritEnv     []string
+	verifySources  bool
+	cleanCheckout  bool
+	defaultTimeout time.Duration
+	maxBuildTime   time.Duration
+	stopPolicy     executil.Policy
+	progressEvery  time.Duration
+	builds         *buildRegistry
+	buildLogs      *buildLogDir
+	counter        *buildCounter
+	baseEnv        []string
+	baseSecrets    []string
 }
 
 func (builder *Builder) Build(request rpc.RemoteRequest) {
+	// The time spent in the queues is measured from now on.
+	receivedT := time.Now()
+
 	// Unmarshal and validate the input data.
 	var args data.BuildArgs
 	if err := request.UnmarshalArgs(&args); err != nil {
-		request.Resolve(2, &data.BuildResult{Error: err.Error()})
+		request.Resolve(2, builder.newResult(describeUnmarshalError(request, err)))
 		return
 	}
 	// Return immediately if this is a dry run.
 	if args.Noop {
-		request.Resolve(0, &data.BuildResult{})
+		request.Resolve(0, builder.newResult(""))
 		return
 	}
 
 	// Validate the arguments.
 	if err := args.Validate(); err != nil {
-		request.Resolve(3, &data.BuildResult{Error: err.Error()})
+		request.Resolve(3, builder.newResult(err.Error()))
 		return
 	}
 
+	// Attach to the build with the same idempotency key, if there is one.
+	// Otherwise the build is recorded so that the following requests can
+	// attach to it.
+	if key := args.IdempotencyKey; key != "" {
+		fingerprint := buildFingerprint(builder.runner.Name, &args)
+		record, owner := builder.builds.begin(key, fingerprint, args.ArtifactsTag, request)
+		if owner == nil {
+			builder.attach(request, record, &args)
+			return
+		}
+		request = owner
+	}
+
+	// The artifacts frames bypass the build log, they are binary data that is
+	// of no use in the log. They never reach the captured output either, that
+	// only contains the script output.
+	artifactsOut := request.Stdout()
+
+	// Mirror the build output into a local file, if requested.
+	if builder.buildLogs != nil {
+		request = builder.buildLogs.tee(request, &args)
+	}
+
+	// Work out the build timeout. The runner default applies when the client
+	// does not request any timeout, and the result is limited by the slave.
+	timeout, clamped := builder.effectiveTimeout(args.Timeout)
+
+	// Resolve the secrets. This is done before anything else so that the build
+	// fails early in case a secret is missing.
+	secretEnv, secretValues, err := builder.resolveSecrets(args.Secrets)
+	if err != nil {
+		request.Resolve(10, builder.newResult(err.Error()))
+		return
+	}
+	baseSecretEnv, baseSecretValues, err := builder.resolveSecrets(builder.baseSecrets)
+	if err != nil {
+		request.Resolve(10, builder.newResult("base environment: "+err.Error()))
+		return
+	}
+	secretValues = append(secretValues, baseSecretValues...)
+
 	// Some shortcuts.
 	stdout := request.Stdout()
 	stderr := request.Stderr()
 
+	// Let the user know in case some of the arguments are not supported.
+	if unknown := unknownArgs(request); len(unknown) != 0 {
+		fmt.Fprintf(stderr, "---> Ignoring unsupported build arguments: %v "+
+			"(the slave is probably older than the client)\n", strings.Join(unknown, ", "))
+	}
+
 	// Generate the project workspace and make sure it exists.
 	repoURL, _ := url.Parse(args.Repository)
 	workspace, err := builder.manager.EnsureWorkspaceExists(repoURL)
 	if err != nil {
-		request.Resolve(4, &data.BuildResult{Error: err.Error()})
+		request.Resolve(4, builder.newResult(err.Error()))
 		return
 	}
 
+	if clamped {
+		fmt.Fprintf(stdout, "---> The requested build timeout of %v exceeds the slave maximum of %v\n",
+			args.Timeout, builder.maxBuildTime)
+	}
+	if timeout != 0 {
+		fmt.Fprintf(stdout, "---> The build will be terminated after %v\n", timeout)
+	}
+
+	// The build may be interrupted while waiting in the queues. It is
+	// resolved with code 5 then, or 12 once it holds an executor, and all
+	// the slots acquired so far are released before that, so nothing is held
+	// once the client knows.
+	var held slots
+	defer held.release()
+
+	// Count the build as queued until it gets an executor. The build stops
+	// being counted before the slots are released.
+	started := false
+	builder.counter.enqueue()
+	defer func() {
+		builder.counter.finish(started)
+	}()
+
 	// Acquire the workspace lock.
 	wsQueue := builder.manager.GetWorkspaceQueue(workspace)
 	errStr := acquire("Locking the project workspace", wsQueue, request)
 	if errStr != "" {
-		request.Resolve(5, &data.BuildResult{Error: errStr})
+		request.Resolve(5, builder.newQueuedResult(errStr, receivedT))
 		return
 	}
-	defer func() {
-		// Release the workspace lock.
-		<-wsQueue
-	}()
+	held = append(held, wsQueue)
+
+	// Make room for the workspace sources. This is just housekeeping,
+	// so the build can continue even if this fails.
+	if err := builder.manager.UseWorkspace(workspace); err != nil {
+		fmt.Fprintf(stderr, "---> Failed to remove old workspaces: %v\n", err)
+	}
 
 	// Acquire a build executor.
 	errStr = acquire("Waiting for a free executor", builder.execQueue, request)
 	if errStr != "" {
-		request.Resolve(5, &data.BuildResult{Error: errStr})
+		held.release()
+		request.Resolve(5, builder.newQueuedResult(errStr, receivedT))
 		return
 	}
-	defer func() {
-		// Free the allocated executor.
-		<-builder.execQueue
-	}()
+	held = append(held, builder.execQueue)
+	builder.counter.start()
+	started = true
 
 	// Start measuring the build time.
 	startT := time.Now()
@@ -89,76 +189,534 @@ func (builder *Builder) Build(request rpc.RemoteRequest) {
 	srcDir := builder.manager.SrcDir(workspace)
 	srcDirExists, err := builder.manager.SrcDirExists(workspace)
 	if err != nil {
-		resolve(request, 6, startT, nil, nil, err)
+		builder.resolve(request, 6, receivedT, startT, nil, nil, err)
 		return
 	}
 
-	vcs, err := vcsutil.GetVCS(repoURL.Scheme)
+	vcsOpts := vcs.Options{
+		Depth:      args.CloneDepth,
+		Submodules: args.Submodules,
+		Progress: func(phase string, percent int) {
+			progress := data.Progress{Phase: phase, Percent: percent}
+			io.WriteString(request.Stdout(), progress.String())
+		},
+	}
+	if store := builder.manager.ObjectStore(); store != nil {
+		vcsOpts.Reference = store.Dir()
+	}
+	repoVCS, err := vcs.GetVCS(repoURL.Scheme, &vcsOpts)
 	if err != nil {
-		resolve(request, 7, startT, nil, nil, err)
+		builder.resolve(request, 7, receivedT, startT, nil, nil, err)
+		return
+	}
+
+	// Make sure the sources have not been modified since the last build.
+	// The sources are cloned again in case they have been.
+	checksummer, _ := repoVCS.(vcs.Checksummer)
+	if !builder.verifySources {
+		checksummer = nil
+	}
+	if checksummer != nil && srcDirExists {
+		ok, err := builder.verifySourceChecksum(checksummer, workspace, srcDir)
+		if err != nil {
+			builder.resolve(request, 6, receivedT, startT, nil, nil, err)
+			return
+		}
+		if !ok {
+			fmt.Fprintln(stdout, "---> The sources have been modified since the last build, cloning them again")
+			if err := os.RemoveAll(srcDir); err != nil {
+				builder.resolve(request, 6, receivedT, startT, nil, nil, err)
+				return
+			}
+			srcDirExists = false
+		}
+	}
+
+	// Start from a pristine clone, if requested. This gets rid of any files
+	// left behind by the previous builds, but the whole repository must be
+	// fetched again, which can take a lot longer than pulling, so this is
+	// off by default. The workspace itself is kept, it is locked by now.
+	if (args.Clean || builder.cleanCheckout) && srcDirExists {
+		fmt.Fprintln(stdout, "---> Removing the sources to make a clean checkout")
+		if err := os.RemoveAll(srcDir); err != nil {
+			builder.resolve(request, 6, receivedT, startT, nil, nil, err)
+			return
+		}
+		if err := builder.manager.SetSourceChecksum(workspace, ""); err != nil {
+			builder.resolve(request, 6, receivedT, startT, nil, nil, err)
+			return
+		}
+		srcDirExists = false
+	}
+
+	// Limit the number of VCS operations running in parallel, if requested.
+	if !builder.waitForVCSSlot(request, &held, receivedT, startT) {
 		return
 	}
 
 	fmt.Fprintf(stdout, "\n---> Pulling the sources (using URL %q)\n", args.Repository)
+	stopProgress := signalProgress(request, builder.progressEvery)
 	if srcDirExists {
-		err = vcs.Pull(repoURL, srcDir, request)
+		err = repoVCS.Pull(repoURL, srcDir, request)
 	} else {
-		err = vcs.Clone(repoURL, srcDir, request)
+		err = repoVCS.Clone(repoURL, srcDir, request)
+	}
+	stopProgress()
+	if builder.vcsQueue != nil {
+		<-builder.vcsQueue
 	}
 	pullT := time.Now()
 	if err != nil {
-		resolve(request, 8, startT, &pullT, nil, err)
+		builder.resolve(request, 8, receivedT, startT, &pullT, nil, err)
 		return
 	}
 
+	// Share the objects with other workspaces. This is just an optimisation,
+	// so the build can continue even if this fails. The shallow clones are
+	// skipped, importing them would make the object store shallow as well.
+	// They do not borrow any objects from the store for the same reason.
+	if args.CloneDepth == 0 {
+		if err := builder.manager.ImportObjects(workspace); err != nil {
+			fmt.Fprintf(stderr, "---> Failed to update the shared object store: %v\n", err)
+		}
+	}
+
+	// Restore the build caches requested by the previous builds.
+	buildCache, err := builder.manager.Cache(workspace)
+	if err != nil {
+		fmt.Fprintf(stderr, "---> Failed to open the build cache: %v\n", err)
+	}
+	if buildCache != nil {
+		builder.restoreCaches(buildCache, workspace, srcDir, stdout, stderr)
+	}
+
 	// Run the specified script.
 	cmd := builder.runner.NewCommand(args.Script)
 
-	env := os.Environ()
-	env = append(env, args.Env...)
+	// The base environment of the slave is overridden by the build.
+	env := mergeEnv(builder.inheritedEnv(), builder.baseEnv, baseSecretEnv, args.Env, secretEnv)
 	env = append(env, "WORKSPACE="+workspace, "SRCDIR="+srcDir)
 	cmd.Env = env
 
 	cmd.Dir = srcDir
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
+	if args.Capture != 0 {
+		// The output is captured after the secrets are redacted.
+		capturing := newCapturingRequest(request, args.Capture)
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, capturing.stdout)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, capturing.stderr)
+		request = capturing
+	}
+	// The writers holding data back between writes are flushed once the script
+	// exits, in the order they are stacked, starting with the outer ones.
+	var redactors []flusher
+	if len(secretValues) != 0 {
+		stdoutRedactor := secrets.NewRedactor(cmd.Stdout, secretValues)
+		stderrRedactor := secrets.NewRedactor(cmd.Stderr, secretValues)
+		cmd.Stdout = stdoutRedactor
+		cmd.Stderr = stderrRedactor
+		redactors = []flusher{stdoutRedactor, stderrRedactor}
+	}
+	var directives *cache.Scanner
+	if buildCache != nil {
+		directives = cache.NewScanner(cmd.Stdout)
+		cmd.Stdout = directives
+	}
+	// The output is transcoded first so that the secrets can be matched.
+	if cmd.Stdout, err = charset.NewWriter(cmd.Stdout, builder.outputCharset); err != nil {
+		builder.resolve(request, 1, receivedT, startT, &pullT, nil, err)
+		return
+	}
+	if cmd.Stderr, err = charset.NewWriter(cmd.Stderr, builder.outputCharset); err != nil {
+		builder.resolve(request, 1, receivedT, startT, &pullT, nil, err)
+		return
+	}
+	var flushers []flusher
+	if builder.outputCharset != "" {
+		flushers = append(flushers, cmd.Stdout.(flusher), cmd.Stderr.(flusher))
+	}
+	flushers = append(flushers, redactors...)
 
 	fmt.Fprintf(stdout, "\n---> Running the script located at %v (using runner %q)\n",
 		args.Script, builder.runner.Name)
-	err = executil.Run(cmd, request.Interrupted())
+	interruptedCh, timedOutCh, stop := interruptAfter(request.Interrupted(), timeout)
+	stopProgress = signalProgress(request, builder.progressEvery)
+	runResult, err := executil.RunWithPolicy(cmd, interruptedCh, builder.stopPolicy)
+	stopProgress()
+	stop()
 	buildT := time.Now()
+
+	// Pass on the output held back by the writers.
+	for _, f := range flushers {
+		f.Flush()
+	}
+
+	// Record the state the sources were left in by the build.
+	if checksummer != nil {
+		if ex := builder.recordSourceChecksum(checksummer, workspace, srcDir); ex != nil {
+			fmt.Fprintf(stderr, "---> Failed to record the source checksum: %v\n", ex)
+		}
+	}
+	if runResult != nil && runResult.Signal != nil {
+		if runResult.Forced {
+			fmt.Fprintf(stdout, "\n---> The build script was killed using %v\n", runResult.Signal)
+		} else {
+			fmt.Fprintf(stdout, "\n---> The build script was stopped using %v\n", runResult.Signal)
+		}
+	}
+	// The build only timed out in case the script was actually stopped,
+	// it could have exited on its own just before the timer fired.
+	select {
+	case <-timedOutCh:
+		if runResult != nil && runResult.Signal != nil {
+			err = fmt.Errorf("build timed out after %v", timeout)
+			builder.resolveRun(request, 9, receivedT, startT, &pullT, &buildT, runResult, err)
+			return
+		}
+	default:
+	}
 	if err != nil {
-		resolve(request, 1, startT, &pullT, &buildT, err)
+		builder.resolveRun(request, 1, receivedT, startT, &pullT, &buildT, runResult, err)
 		return
 	}
 
+	// Process the cache directives, only for successful builds.
+	if buildCache != nil {
+		builder.saveCaches(buildCache, directives, workspace, srcDir, stdout, stderr)
+	}
+
+	// Send the artifacts back, if requested.
+	if len(args.Artifacts) != 0 && args.ArtifactsTag != "" {
+		sendArtifacts(&args, srcDir, artifactsOut, stdout, stderr)
+	}
+
 	// Return success, at last.
-	resolve(request, 0, startT, &pullT, &buildT, nil)
+	builder.resolveRun(request, 0, receivedT, startT, &pullT, &buildT, runResult, nil)
+}
+
+// effectiveTimeout returns the timeout to be used for a build requesting
+// the given timeout. clamped is set when the requested timeout was cut down
+// to the slave maximum. Zero means that there is no timeout.
+func (builder *Builder) effectiveTimeout(requested time.Duration) (timeout time.Duration, clamped bool) {
+	timeout = requested
+	if timeout == 0 {
+		timeout = builder.defaultTimeout
+	}
+	if max := builder.maxBuildTime; max != 0 {
+		switch {
+		case timeout == 0:
+			timeout = max
+		case timeout > max:
+			timeout = max
+			clamped = requested != 0
+		}
+	}
+	return
+}
+
+// describeUnmarshalError tells a malformed payload from a payload that is
+// valid, but does not match BuildArgs, which is usually caused by the client
+// and the slave versions being incompatible.
+func describeUnmarshalError(request rpc.RemoteRequest, err error) string {
+	var generic map[string]interface{}
+	if ex := request.UnmarshalArgs(&generic); ex != nil {
+		return fmt.Sprintf("malformed arguments for method %v: %v", request.Method(), err)
+	}
+	return fmt.Sprintf("incompatible arguments for method %v: %v; "+
+		"make sure the client and the slave versions are compatible", request.Method(), err)
 }
 
+// unknownArgs returns the argument keys that BuildArgs does not know.
+func unknownArgs(request rpc.RemoteRequest) []string {
+	var generic map[string]interface{}
+	if err := request.UnmarshalArgs(&generic); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(generic))
+	for key := range generic {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return data.UnknownArgs(keys)
+}
+
+// inheritedEnv returns the part of the slave environment that is passed on to
+// the build scripts. Only the allowed variables are passed on by default,
+// see filterEnv.
+func (builder *Builder) inheritedEnv() []string {
+	env := os.Environ()
+	if builder.inheritAllEnv {
+		return env
+	}
+	return filterEnv(env, builder.inheritEnv)
+}
+
+// mergeEnv merges the lists of KEY=VALUE pairs. The later lists override
+// the variables defined in the earlier ones, the order is kept otherwise.
+func mergeEnv(lists ...[]string) []string {
+	var (
+		env   []string
+		index = make(map[string]int)
+	)
+	for _, list := range lists {
+		for _, kv := range list {
+			key := strings.SplitN(kv, "=", 2)[0]
+			if i, ok := index[key]; ok {
+				env[i] = kv
+				continue
+			}
+			index[key] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// verifySourceChecksum checks the sources against the checksum recorded
+// after the last build. The checksum is removed so that a failed pull does not
+// look like tampering next time. The sources are not checked when there is no
+// checksum recorded, e.g. when the verification has just been enabled.
+func (builder *Builder) verifySourceChecksum(c vcs.Checksummer, workspace, srcDir string) (bool, error) {
+	recorded, err := builder.manager.SourceChecksum(workspace)
+	if err != nil || recorded == "" {
+		return true, err
+	}
+	if err := builder.manager.SetSourceChecksum(workspace, ""); err != nil {
+		return false, err
+	}
+
+	sum, err := c.Checksum(srcDir)
+	if err != nil {
+		// The sources are broken enough to be cloned again.
+		return false, nil
+	}
+	return sum == recorded, nil
+}
+
+func (builder *Builder) recordSourceChecksum(c vcs.Checksummer, workspace, srcDir string) error {
+	sum, err := c.Checksum(srcDir)
+	if err != nil {
+		return err
+	}
+	return builder.manager.SetSourceChecksum(workspace, sum)
+}
+
+// restoreCaches restores the caches listed in the workspace restore list.
+// Failing to restore a cache is not fatal, the build just takes longer.
+func (builder *Builder) restoreCaches(c *cache.Cache, workspace, srcDir string, stdout, stderr io.Writer) {
+	ds, err := cache.ReadRestoreList(builder.manager.CacheRestoreList(workspace))
+	if err != nil {
+		fmt.Fprintf(stderr, "---> Failed to read the cache restore list: %v\n", err)
+		return
+	}
+	for _, d := range ds {
+		restored, err := c.Restore(d.Key, srcDir, d.Path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(stderr, "---> Failed to restore cache %v into %v: %v\n", d.Key, d.Path, err)
+		case restored:
+			fmt.Fprintf(stdout, "---> Restored cache %v into %v\n", d.Key, d.Path)
+		}
+	}
+}
+
+// saveCaches processes the cache directives emitted by the build script.
+// The restore list of the workspace is replaced with the restore directives
+// emitted this time. Failing to save a cache is not fatal, the build has
+// succeeded anyway.
+func (builder *Builder) saveCaches(c *cache.Cache, s *cache.Scanner, workspace, srcDir string, stdout, stderr io.Writer) {
+	ds, errs := s.Directives()
+	for _, err := range errs {
+		fmt.Fprintf(stderr, "---> Ignoring cache directive: %v\n", err)
+	}
+	for _, d := range ds {
+		if d.Action != cache.ActionSave {
+			continue
+		}
+		if err := c.Save(d.Key, srcDir, d.Path); err != nil {
+			fmt.Fprintf(stderr, "---> Failed to save %v into cache %v: %v\n", d.Path, d.Key, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "\n---> Saved %v into cache %v\n", d.Path, d.Key)
+	}
+
+	if err := cache.WriteRestoreList(builder.manager.CacheRestoreList(workspace), ds); err != nil {
+		fmt.Fprintf(stderr, "---> Failed to write the cache restore list: %v\n", err)
+	}
+}
+
+// resolveSecrets turns the KEY=BACKEND:REF pairs into KEY=VALUE pairs.
+// The secret values are returned as well so that they can be redacted.
+func (builder *Builder) resolveSecrets(refs []string) (env, values []string, err error) {
+	for _, kv := range refs {
+		parts := strings.SplitN(kv, "=", 2)
+		value, err := builder.secrets.Resolve(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve secret %v: %v", parts[0], err)
+		}
+		env = append(env, parts[0]+"="+value)
+		values = append(values, value)
+	}
+	return
+}
+
+// interruptAfter returns a channel that is closed when either interrupted is
+// closed or the timeout elapses, in which case timedOut is closed as well.
+// Zero timeout means that there is no timeout. stop must be called to release
+// the associated resources.
+func interruptAfter(interrupted <-chan struct{}, timeout time.Duration) (ch, timedOut <-chan struct{}, stop func()) {
+	if timeout == 0 {
+		return interrupted, make(chan struct{}), func() {}
+	}
+
+	var (
+		interruptCh = make(chan struct{})
+		timeoutCh   = make(chan struct{})
+		stopCh      = make(chan struct{})
+		doneCh      = make(chan struct{})
+		timer       = time.NewTimer(timeout)
+	)
+	go func() {
+		defer close(doneCh)
+		defer timer.Stop()
+		select {
+		case <-interrupted:
+			close(interruptCh)
+		case <-timer.C:
+			close(timeoutCh)
+			close(interruptCh)
+		case <-stopCh:
+		}
+	}()
+	return interruptCh, timeoutCh, func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+// signalProgress signals progress for the request every interval until stop
+// is called, so that the client knows the build is alive even when there is
+// no output. Zero interval means that no progress is signalled.
+func signalProgress(request rpc.RemoteRequest, interval time.Duration) (stop func()) {
+	if interval == 0 {
+		return func() {}
+	}
+
+	var (
+		stopCh = make(chan struct{})
+		doneCh = make(chan struct{})
+		ticker = time.NewTicker(interval)
+	)
+	go func() {
+		defer close(doneCh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// The client just misses the signal in case this fails.
+				request.SignalProgress()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+// flusher is implemented by the output writers holding data back.
+type flusher interface {
+	Flush() error
+}
+
+// acquire takes a slot in the queue. It returns an error string when
+// the request is interrupted first, in which case no slot is taken.
 func acquire(msg string, queue chan bool, request rpc.RemoteRequest) (err string) {
 	stdout := request.Stdout()
 	fmt.Fprintf(stdout, "---> %v\n", msg)
 	for {
 		select {
 		case queue <- true:
+			// Both cases can be ready at the same time, interrupt wins.
+			select {
+			case <-request.Interrupted():
+				<-queue
+				return "interrupted while queued"
+			default:
+			}
 			return
 		case <-request.Interrupted():
-			return "interrupted"
+			return "interrupted while queued"
 		case <-time.After(30 * time.Second):
 			fmt.Fprintln(stdout, "---> ...")
 		}
 	}
 }
 
-func resolve(req rpc.RemoteRequest, code rpc.ReturnCode, startT time.Time, pullT *time.Time, buildT *time.Time, err error) {
-	result := new(data.BuildResult)
+// waitForVCSSlot takes a VCS slot in case the number of VCS operations is
+// limited. The build already holds an executor at this point, so when it is
+// interrupted, it is resolved with code 12 rather than 5, once all the slots
+// held are released. It returns false in case the build has been resolved.
+func (builder *Builder) waitForVCSSlot(request rpc.RemoteRequest, held *slots, receivedT, startT time.Time) bool {
+	if builder.vcsQueue == nil {
+		return true
+	}
+	if errStr := acquire("Waiting for a free VCS slot", builder.vcsQueue, request); errStr != "" {
+		held.release()
+		builder.resolve(request, 12, receivedT, startT, nil, nil,
+			errors.New("interrupted while waiting for a free VCS slot"))
+		return false
+	}
+	return true
+}
+
+// slots are the queue slots held by a build.
+type slots []chan bool
+
+// release frees the slots in the reverse order. It can be called repeatedly.
+func (s *slots) release() {
+	for i := len(*s) - 1; i >= 0; i-- {
+		<-(*s)[i]
+	}
+	*s = nil
+}
+
+func (builder *Builder) newResult(errStr string) *data.BuildResult {
+	return &data.BuildResult{
+		Slave: builder.identity,
+		Error: errStr,
+	}
+}
+
+// newQueuedResult returns the result for the builds interrupted while queued.
+func (builder *Builder) newQueuedResult(errStr string, receivedT time.Time) *data.BuildResult {
+	result := builder.newResult(errStr)
+	result.QueueDuration = time.Since(receivedT)
+	return result
+}
+
+func (builder *Builder) resolve(req rpc.RemoteRequest, code rpc.ReturnCode, receivedT, startT time.Time, pullT *time.Time, buildT *time.Time, err error) {
+	builder.resolveRun(req, code, receivedT, startT, pullT, buildT, nil, err)
+}
+
+// resolveRun is resolve for the builds that got to running the script,
+// the resource usage of the script is included in the result.
+func (builder *Builder) resolveRun(req rpc.RemoteRequest, code rpc.ReturnCode, receivedT, startT time.Time, pullT *time.Time, buildT *time.Time, run *executil.Result, err error) {
+	result := builder.newResult("")
+	result.QueueDuration = startT.Sub(receivedT)
 	if pullT != nil {
 		result.PullDuration = pullT.Sub(startT)
 	}
 	if buildT != nil {
 		result.BuildDuration = buildT.Sub(*pullT)
 	}
+	if run != nil {
+		result.UserTime = run.UserTime
+		result.SystemTime = run.SystemTime
+	}
 	if err != nil {
 		result.Error = err.Error()
 		fmt.Fprintln(req.Stdout(), "\n---> Build failed")
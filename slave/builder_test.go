@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+)
+
+// testRequest is a RemoteRequest that records how it was resolved.
+type testRequest struct {
+	rpc.RemoteRequest
+	output      bytes.Buffer
+	interrupted chan struct{}
+	resolved    chan struct{}
+	code        rpc.ReturnCode
+}
+
+func newTestRequest() *testRequest {
+	return &testRequest{
+		interrupted: make(chan struct{}),
+		resolved:    make(chan struct{}),
+	}
+}
+
+func (req *testRequest) Stdout() io.Writer            { return &req.output }
+func (req *testRequest) Stderr() io.Writer            { return &req.output }
+func (req *testRequest) Interrupted() <-chan struct{} { return req.interrupted }
+func (req *testRequest) Resolved() <-chan struct{}    { return req.resolved }
+func (req *testRequest) Resolve(code rpc.ReturnCode, value interface{}) error {
+	req.code = code
+	close(req.resolved)
+	return nil
+}
+
+func TestAcquire_Free(t *testing.T) {
+	queue := make(chan bool, 1)
+	if errStr := acquire("Waiting", queue, newTestRequest()); errStr != "" {
+		t.Fatalf("unexpected error: %v", errStr)
+	}
+	if len(queue) != 1 {
+		t.Error("the slot was not taken")
+	}
+}
+
+func TestAcquire_Interrupted(t *testing.T) {
+	queue := make(chan bool, 1)
+	queue <- true
+	request := newTestRequest()
+	close(request.interrupted)
+
+	if errStr := acquire("Waiting", queue, request); errStr == "" {
+		t.Fatal("expected the acquire to be interrupted")
+	}
+	if len(queue) != 1 {
+		t.Error("the queue was modified")
+	}
+}
+
+func TestAcquire_InterruptedWhileFree(t *testing.T) {
+	queue := make(chan bool, 1)
+	request := newTestRequest()
+	close(request.interrupted)
+
+	if errStr := acquire("Waiting", queue, request); errStr == "" {
+		t.Fatal("expected the acquire to be interrupted")
+	}
+	if len(queue) != 0 {
+		t.Error("the slot was taken")
+	}
+}
+
+func TestWaitForVCSSlot_Free(t *testing.T) {
+	builder := &Builder{vcsQueue: make(chan bool, 1)}
+	var held slots
+
+	now := time.Now()
+	if !builder.waitForVCSSlot(newTestRequest(), &held, now, now) {
+		t.Fatal("the build was resolved")
+	}
+	if len(builder.vcsQueue) != 1 {
+		t.Error("the VCS slot was not taken")
+	}
+}
+
+func TestWaitForVCSSlot_Unlimited(t *testing.T) {
+	builder := new(Builder)
+	var held slots
+
+	now := time.Now()
+	if !builder.waitForVCSSlot(newTestRequest(), &held, now, now) {
+		t.Fatal("the build was resolved")
+	}
+}
+
+func TestWaitForVCSSlot_Interrupted(t *testing.T) {
+	// The executor is held, all the VCS slots are taken by other builds.
+	execQueue := make(chan bool, 1)
+	execQueue <- true
+	builder := &Builder{
+		execQueue: execQueue,
+		vcsQueue:  make(chan bool, 1),
+	}
+	builder.vcsQueue <- true
+	held := slots{execQueue}
+
+	request := newTestRequest()
+	time.AfterFunc(100*time.Millisecond, func() { close(request.interrupted) })
+
+	now := time.Now()
+	if builder.waitForVCSSlot(request, &held, now, now) {
+		t.Fatal("the build was not interrupted")
+	}
+
+	select {
+	case <-request.resolved:
+	default:
+		t.Fatal("the request was not resolved")
+	}
+	if request.code != 12 {
+		t.Errorf("expected return code 12, got %v", request.code)
+	}
+	if len(execQueue) != 0 {
+		t.Error("the executor was not released")
+	}
+	if len(builder.vcsQueue) != 1 {
+		t.Error("the VCS queue was modified")
+	}
+	if len(held) != 0 {
+		t.Error("the slots are still marked as held")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// Cider
+	"github.com/cider/cider/data"
+
+	// Meeko
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+
+	// Others
+	log "github.com/cihub/seelog"
+)
+
+const (
+	buildLogSuffix     = ".log"
+	buildLogTimeLayout = "20060102T150405.000Z"
+)
+
+// unsafeNameRegexp matches the characters replaced in the build log names.
+var unsafeNameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// buildLogDir keeps the output of the builds in the files located in dir.
+// The oldest files are removed once there are more than maxFiles of them or
+// once they are older than maxAge. Zero means that there is no limit.
+type buildLogDir struct {
+	dir      string
+	maxFiles int
+	maxAge   time.Duration
+	mu       *sync.Mutex
+}
+
+func openBuildLogDir(dir string, maxFiles int, maxAge time.Duration) (*buildLogDir, error) {
+	if err := ensureDirectoryExists(dir); err != nil {
+		return nil, fmt.Errorf("failed to create build log directory %v: %v", dir, err)
+	}
+	logs := &buildLogDir{dir, maxFiles, maxAge, new(sync.Mutex)}
+	return logs, logs.prune()
+}
+
+// tee returns request wrapped so that the output is copied into a new build
+// log file. The request is returned as it is in case the file cannot be
+// created, the build does not fail because of that.
+func (logs *buildLogDir) tee(request rpc.RemoteRequest, args *data.BuildArgs) rpc.RemoteRequest {
+	repoURL, _ := url.Parse(args.Repository)
+	host, path := normalizeRepoURL(repoURL)
+	startT := time.Now().UTC()
+
+	base := strings.Join([]string{
+		startT.Format(buildLogTimeLayout),
+		unsafeNameRegexp.ReplaceAllString(request.Sender(), "_"),
+		fmt.Sprint(request.Id()),
+		unsafeNameRegexp.ReplaceAllString(strings.Trim(host+path, "/"), "_"),
+	}, "_")
+
+	// The name can only collide when the request IDs are reused quickly.
+	var (
+		file *os.File
+		err  error
+	)
+	for i := 0; i < 10; i++ {
+		name := base
+		if i != 0 {
+			name += fmt.Sprintf("_%v", i)
+		}
+		file, err = os.OpenFile(filepath.Join(logs.dir, name+buildLogSuffix),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		log.Warnf("Failed to create build log: %v", err)
+		return request
+	}
+	if err := logs.prune(); err != nil {
+		log.Warnf("Failed to remove old build logs: %v", err)
+	}
+
+	fmt.Fprintf(file, "---> Build of %v requested by %v using method %v at %v\n",
+		args.Repository, request.Sender(), request.Method(), startT.Format(time.RFC3339))
+
+	logFile := &lockedWriter{w: file, mu: new(sync.Mutex)}
+	return &loggingRequest{
+		RemoteRequest: request,
+		file:          file,
+		log:           logFile,
+		stdout:        &teeWriter{request.Stdout(), logFile},
+		stderr:        &teeWriter{request.Stderr(), logFile},
+	}
+}
+
+// prune removes the build logs exceeding the retention limits.
+func (logs *buildLogDir) prune() error {
+	if logs.maxFiles == 0 && logs.maxAge == 0 {
+		return nil
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(logs.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), buildLogSuffix) {
+			files = append(files, info)
+		}
+	}
+	// The names start with the build start time, newest first.
+	sort.Sort(sort.Reverse(byName(files)))
+
+	now := time.Now()
+	for i, info := range files {
+		keep := logs.maxFiles == 0 || i < logs.maxFiles
+		if logs.maxAge != 0 && now.Sub(info.ModTime()) > logs.maxAge {
+			keep = false
+		}
+		if keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(logs.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type byName []os.FileInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// loggingRequest copies the output into the build log file,
+// which is closed once the request is resolved.
+type loggingRequest struct {
+	rpc.RemoteRequest
+	file   *os.File
+	log    *lockedWriter
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func (request *loggingRequest) Stdout() io.Writer {
+	return request.stdout
+}
+
+func (request *loggingRequest) Stderr() io.Writer {
+	return request.stderr
+}
+
+func (request *loggingRequest) Resolve(code rpc.ReturnCode, value interface{}) error {
+	err := request.RemoteRequest.Resolve(code, value)
+	request.log.mu.Lock()
+	fmt.Fprintf(request.file, "\n---> Resolved with return code %v\n", code)
+	request.file.Close()
+	request.log.mu.Unlock()
+	return err
+}
+
+// teeWriter writes into w and copies the data into log. Failing to write
+// the log does not affect writing into w.
+type teeWriter struct {
+	w   io.Writer
+	log io.Writer
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.log.Write(p)
+	return n, err
+}
+
+// lockedWriter serializes the writes, so that the output streams can share
+// the same file.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
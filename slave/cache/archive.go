@@ -0,0 +1,27 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"errors"
+	"io"
+)
+
+var errLimitExceeded = errors.New("size limit exceeded")
+
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (w *limitedWriter) Write(p []byte) (n int, err error) {
+	if int64(len(p)) > w.remaining {
+		return 0, errLimitExceeded
+	}
+	n, err = w.w.Write(p)
+	w.remaining -= int64(n)
+	return
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package cache implements the build caches controlled by the build scripts.
+//
+// The build scripts control the caches by printing directives to stdout.
+// A directive must occupy the whole line and it must look like
+//
+//	::cider:cache:save:KEY:PATH
+//	::cider:cache:restore:KEY:PATH
+//
+// KEY consists of letters, digits, '.', '_' and '-'. PATH is a relative path
+// within SRCDIR, it must not point outside of SRCDIR.
+//
+// The build script cannot wait for the build slave to process a directive,
+// so the directives are never processed while the script is running:
+//
+//	save    - PATH is saved under KEY once the script finishes successfully.
+//	restore - the directive is remembered for the workspace. Before the script
+//	          is run in any following build, KEY is restored into PATH unless
+//	          PATH already exists.
+//
+// The keys are only valid within a namespace, see Cache.Namespace, so that
+// the builds of one repository cannot replace the caches of another one.
+//
+// The directives are passed on to the build output unchanged.
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cider/cider/utils/archive"
+)
+
+const directivePrefix = "::cider:cache:"
+
+const (
+	ActionSave    = "save"
+	ActionRestore = "restore"
+)
+
+var keyRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type Directive struct {
+	Action string
+	Key    string
+	Path   string
+}
+
+func (d *Directive) String() string {
+	return directivePrefix + d.Action + ":" + d.Key + ":" + d.Path
+}
+
+// ParseDirective parses a single output line. It returns nil in case the line
+// is not a cache directive at all.
+func ParseDirective(line string) (*Directive, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, directivePrefix) {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(line[len(directivePrefix):], ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cache directive: %v", line)
+	}
+	d := &Directive{parts[0], parts[1], parts[2]}
+
+	switch d.Action {
+	case ActionSave, ActionRestore:
+	default:
+		return nil, fmt.Errorf("unknown cache action: %v", d.Action)
+	}
+	if !keyRegexp.MatchString(d.Key) {
+		return nil, fmt.Errorf("invalid cache key: %v", d.Key)
+	}
+	if err := validatePath(d.Path); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func validatePath(path string) error {
+	if err := archive.ValidatePath(path); err != nil {
+		return fmt.Errorf("invalid cache path: %v", path)
+	}
+	return nil
+}
+
+// Scanner is a writer that passes all the data on to the underlying writer
+// while collecting the cache directives.
+type Scanner struct {
+	w          io.Writer
+	line       bytes.Buffer
+	directives []*Directive
+	errs       []error
+}
+
+func NewScanner(w io.Writer) *Scanner {
+	return &Scanner{w: w}
+}
+
+func (s *Scanner) Write(p []byte) (n int, err error) {
+	n, err = s.w.Write(p)
+
+	// Only the beginning of a line is kept, that is enough to detect
+	// the directives, which are always rather short.
+	for _, b := range p {
+		if b == '\n' {
+			s.flushLine()
+			continue
+		}
+		if s.line.Len() < 4096 {
+			s.line.WriteByte(b)
+		}
+	}
+	return
+}
+
+func (s *Scanner) flushLine() {
+	d, err := ParseDirective(s.line.String())
+	switch {
+	case err != nil:
+		s.errs = append(s.errs, err)
+	case d != nil:
+		s.directives = append(s.directives, d)
+	}
+	s.line.Reset()
+}
+
+// Directives returns the directives collected so far, including the one on
+// the last line even if it was not terminated, and the parsing errors.
+func (s *Scanner) Directives() ([]*Directive, []error) {
+	if s.line.Len() != 0 {
+		s.flushLine()
+	}
+	return s.directives, s.errs
+}
+
+// Cache stores the cached paths as archives in a directory. The total size of
+// the archives is limited, the least recently used archives are evicted.
+// The archives are stored in a subdirectory for every namespace.
+type Cache struct {
+	dir       string
+	namespace string
+	limit     int64
+	mu        *sync.Mutex
+}
+
+// Open opens the cache located in dir, creating the directory if necessary.
+// limit is the maximum total size of the cache in bytes.
+func Open(dir string, limit int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, limit: limit, mu: new(sync.Mutex)}, nil
+}
+
+// Namespace returns the cache with the keys restricted to the given namespace.
+// The same keys in different namespaces refer to different archives.
+// The namespaces share the size limit. The name must be a valid key.
+func (cache *Cache) Namespace(name string) (*Cache, error) {
+	if !keyRegexp.MatchString(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid cache namespace: %v", name)
+	}
+	c := *cache
+	c.namespace = name
+	return &c, nil
+}
+
+func (cache *Cache) archivePath(key string) string {
+	return filepath.Join(cache.dir, cache.namespace, key+".tar.gz")
+}
+
+// Save archives srcDir/path under key, replacing the previous archive.
+func (cache *Cache) Save(key, srcDir, path string) error {
+	if err := validatePath(path); err != nil {
+		return err
+	}
+
+	// Write into a temporary file first so that a failed or a concurrent save
+	// never leaves a broken archive behind.
+	tmp, err := ioutil.TempFile(cache.dir, ".save-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	limited := &limitedWriter{tmp, cache.limit}
+	if err := archive.Pack(limited, srcDir, []string{path}); err != nil {
+		tmp.Close()
+		if err == errLimitExceeded {
+			return fmt.Errorf("cache %v exceeds the cache size limit of %v bytes", key, cache.limit)
+		}
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	dst := cache.archivePath(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return cache.evict()
+}
+
+// Restore extracts the archive saved under key into srcDir/path unless
+// the path already exists. It returns whether anything was restored.
+func (cache *Cache) Restore(key, srcDir, path string) (bool, error) {
+	if err := validatePath(path); err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(filepath.Join(srcDir, path)); err == nil || !os.IsNotExist(err) {
+		return false, err
+	}
+
+	cache.mu.Lock()
+	file, err := os.Open(cache.archivePath(key))
+	if err != nil {
+		cache.mu.Unlock()
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	// Mark the archive as recently used.
+	now := time.Now()
+	os.Chtimes(file.Name(), now, now)
+	cache.mu.Unlock()
+	defer file.Close()
+
+	if err := archive.Unpack(file, srcDir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// evict removes the least recently used archives of all the namespaces until
+// the cache fits into the size limit. It must be called with the mutex held.
+// The archives saved in the cache directory directly, before the namespaces
+// were introduced, are never restored, but they are evicted the same way.
+func (cache *Cache) evict() error {
+	var (
+		archives []archiveInfo
+		total    int64
+	)
+	collect := func(dir string) ([]os.FileInfo, error) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), ".tar.gz") &&
+				!strings.HasPrefix(info.Name(), ".") {
+				archives = append(archives, archiveInfo{filepath.Join(dir, info.Name()), info})
+				total += info.Size()
+			}
+		}
+		return infos, nil
+	}
+
+	infos, err := collect(cache.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			if _, err := collect(filepath.Join(cache.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Sort(byModTime(archives))
+
+	for _, archive := range archives {
+		if total <= cache.limit {
+			break
+		}
+		if err := os.Remove(archive.path); err != nil {
+			return err
+		}
+		total -= archive.Size()
+
+		// Drop the namespace directory once it is empty, this fails otherwise.
+		if dir := filepath.Dir(archive.path); dir != cache.dir {
+			os.Remove(dir)
+		}
+	}
+	return nil
+}
+
+type archiveInfo struct {
+	path string
+	os.FileInfo
+}
+
+type byModTime []archiveInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ReadRestoreList reads the restore directives remembered in the given file.
+func ReadRestoreList(path string) ([]*Directive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var ds []*Directive
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		d, err := ParseDirective(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if d != nil && d.Action == ActionRestore {
+			ds = append(ds, d)
+		}
+	}
+	return ds, scanner.Err()
+}
+
+// WriteRestoreList remembers the restore directives in the given file.
+func WriteRestoreList(path string, ds []*Directive) error {
+	var buf bytes.Buffer
+	for _, d := range ds {
+		if d.Action == ActionRestore {
+			buf.WriteString(d.String())
+			buf.WriteByte('\n')
+		}
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0640)
+}
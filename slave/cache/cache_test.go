@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCache_Namespace(t *testing.T) {
+	root, err := ioutil.TempDir("", "cider-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := func(name string) string {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	c, err := Open(filepath.Join(root, "cache"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Namespace("../escape"); err == nil {
+		t.Error("invalid namespace accepted")
+	}
+	a, err := c.Namespace("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.Namespace("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Save the key in namespace a.
+	saveDir := srcDir("save")
+	if err := os.Mkdir(filepath.Join(saveDir, "deps"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(saveDir, "deps", "lib"), []byte("a"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Save("deps", saveDir, "deps"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key is not visible in namespace b.
+	restored, err := b.Restore("deps", srcDir("b"), "deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored {
+		t.Error("cache restored from another namespace")
+	}
+
+	// It is restored in namespace a.
+	restoreDir := srcDir("a")
+	restored, err = a.Restore("deps", restoreDir, "deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored {
+		t.Fatal("cache not restored")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(restoreDir, "deps", "lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "a" {
+		t.Errorf("expected the saved content, got %q", content)
+	}
+}
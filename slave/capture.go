@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"sync"
+	"unicode/utf8"
+
+	// Cider
+	"github.com/cider/cider/data"
+
+	// Meeko
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+)
+
+// maxCapture is the maximum number of bytes captured per output stream,
+// no matter what the build requests.
+const maxCapture = 1 << 20
+
+// tailBuffer keeps the last max bytes written into it.
+type tailBuffer struct {
+	max int
+	buf []byte
+	mu  *sync.Mutex
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max, mu: new(sync.Mutex)}
+}
+
+func (tail *tailBuffer) Write(p []byte) (int, error) {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+
+	if len(p) >= tail.max {
+		tail.buf = append(tail.buf[:0], p[len(p)-tail.max:]...)
+		return len(p), nil
+	}
+	if over := len(tail.buf) + len(p) - tail.max; over > 0 {
+		tail.buf = append(tail.buf[:0], tail.buf[over:]...)
+	}
+	tail.buf = append(tail.buf, p...)
+	return len(p), nil
+}
+
+// String returns the buffer content, dropping the partial rune at the start
+// that may have been left there by trimming.
+func (tail *tailBuffer) String() string {
+	tail.mu.Lock()
+	defer tail.mu.Unlock()
+
+	buf := tail.buf
+	for i := 0; i < utf8.UTFMax && len(buf) != 0 && !utf8.RuneStart(buf[0]); i++ {
+		buf = buf[1:]
+	}
+	return string(buf)
+}
+
+// capturingRequest fills the captured output into the build result
+// the request is resolved with.
+type capturingRequest struct {
+	rpc.RemoteRequest
+	stdout *tailBuffer
+	stderr *tailBuffer
+}
+
+func newCapturingRequest(request rpc.RemoteRequest, limit uint) *capturingRequest {
+	if limit > maxCapture {
+		limit = maxCapture
+	}
+	return &capturingRequest{
+		RemoteRequest: request,
+		stdout:        newTailBuffer(int(limit)),
+		stderr:        newTailBuffer(int(limit)),
+	}
+}
+
+func (request *capturingRequest) Resolve(code rpc.ReturnCode, value interface{}) error {
+	if result, ok := value.(*data.BuildResult); ok {
+		result.Stdout = request.stdout.String()
+		result.Stderr = request.stderr.String()
+	}
+	return request.RemoteRequest.Resolve(code, value)
+}
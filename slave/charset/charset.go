@@ -0,0 +1,171 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package charset transcodes build output into UTF-8.
+//
+// Some build tools, mostly on Windows, do not emit UTF-8. The output would
+// then arrive garbled on the client side, so it is transcoded on the slave.
+package charset
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// decoder decodes as much of src as possible into dst. It returns the number
+// of bytes consumed, the rest is kept until more data is available.
+type decoder func(dst []byte, src []byte) ([]byte, int)
+
+var decoders = map[string]decoder{
+	"iso-8859-1":   decodeLatin1,
+	"windows-1252": decodeWindows1252,
+	"utf-16le":     decodeUTF16(false),
+	"utf-16be":     decodeUTF16(true),
+}
+
+// Supported returns the names of the supported source charsets.
+func Supported() []string {
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate returns an error in case the charset is not supported.
+// Empty charset means that no transcoding takes place, which is always valid.
+func Validate(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := decoders[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unsupported charset: %v (supported: %v)",
+			name, strings.Join(Supported(), ", "))
+	}
+	return nil
+}
+
+// NewWriter returns a writer that transcodes the data from the given charset
+// into UTF-8 before writing it into w. Empty charset means passthrough.
+//
+// The transcoding writer holds back the sequences split between two writes.
+// It has a Flush method that must be called once all the data is written.
+func NewWriter(w io.Writer, name string) (io.Writer, error) {
+	if name == "" {
+		return w, nil
+	}
+	if err := Validate(name); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, decode: decoders[strings.ToLower(name)]}, nil
+}
+
+type writer struct {
+	w       io.Writer
+	decode  decoder
+	pending []byte
+	buf     []byte
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	// Sequences can be split between two writes, in which case the beginning
+	// is kept in pending until the rest arrives.
+	src := p
+	if len(w.pending) != 0 {
+		src = append(w.pending, p...)
+	}
+
+	out, consumed := w.decode(w.buf[:0], src)
+	w.buf = out
+	w.pending = append(w.pending[:0], src[consumed:]...)
+
+	if len(out) != 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes U+FFFD in case there is an incomplete sequence held back,
+// since the rest of the sequence is never going to arrive.
+func (w *writer) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	w.pending = w.pending[:0]
+	_, err := w.w.Write(appendRune(nil, utf8.RuneError))
+	return err
+}
+
+func decodeLatin1(dst []byte, src []byte) ([]byte, int) {
+	for _, b := range src {
+		dst = appendRune(dst, rune(b))
+	}
+	return dst, len(src)
+}
+
+// windows1252 maps the bytes 0x80-0x9F, which is where Windows-1252 differs
+// from ISO-8859-1. Undefined positions map to the replacement character.
+var windows1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(dst []byte, src []byte) ([]byte, int) {
+	for _, b := range src {
+		if b >= 0x80 && b <= 0x9F {
+			dst = appendRune(dst, windows1252[b-0x80])
+		} else {
+			dst = appendRune(dst, rune(b))
+		}
+	}
+	return dst, len(src)
+}
+
+func decodeUTF16(bigEndian bool) decoder {
+	unit := func(b []byte) uint16 {
+		if bigEndian {
+			return uint16(b[0])<<8 | uint16(b[1])
+		}
+		return uint16(b[1])<<8 | uint16(b[0])
+	}
+
+	return func(dst []byte, src []byte) ([]byte, int) {
+		i := 0
+		for ; i+1 < len(src); i += 2 {
+			r := rune(unit(src[i:]))
+			if utf16.IsSurrogate(r) {
+				// Wait for the other half of the surrogate pair.
+				if i+3 >= len(src) {
+					break
+				}
+				r = utf16.DecodeRune(r, rune(unit(src[i+2:])))
+				if r != utf8.RuneError {
+					i += 2
+				}
+			}
+			// Drop the byte order mark.
+			if r == '\uFEFF' {
+				continue
+			}
+			dst = appendRune(dst, r)
+		}
+		return dst, i
+	}
+}
+
+func appendRune(dst []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(dst, buf[:n]...)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package charset
+
+import (
+	"bytes"
+	"testing"
+)
+
+// transcode writes the input in chunks of the given size and flushes
+// the writer at the end.
+func transcode(t *testing.T, name string, input []byte, chunk int) string {
+	var out bytes.Buffer
+	w, err := NewWriter(&out, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(input) != 0 {
+		n := chunk
+		if n > len(input) {
+			n = len(input)
+		}
+		if _, err := w.Write(input[:n]); err != nil {
+			t.Fatal(err)
+		}
+		input = input[n:]
+	}
+	if err := w.(*writer).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestWriter_SplitSequences(t *testing.T) {
+	testCases := []struct {
+		charset  string
+		input    []byte
+		expected string
+	}{
+		// "aé€"
+		{"iso-8859-1", []byte{'a', 0xE9}, "aé"},
+		{"windows-1252", []byte{'a', 0xE9, 0x80}, "aé€"},
+		// "a€𝄞" with the byte order mark
+		{"utf-16le", []byte{0xFF, 0xFE, 'a', 0, 0xAC, 0x20, 0x34, 0xD8, 0x1E, 0xDD}, "a€𝄞"},
+		{"utf-16be", []byte{0xFE, 0xFF, 0, 'a', 0x20, 0xAC, 0xD8, 0x34, 0xDD, 0x1E}, "a€𝄞"},
+	}
+
+	for _, tc := range testCases {
+		for chunk := 1; chunk <= len(tc.input); chunk++ {
+			if out := transcode(t, tc.charset, tc.input, chunk); out != tc.expected {
+				t.Errorf("%v, chunk %v: expected %q, got %q", tc.charset, chunk, tc.expected, out)
+			}
+		}
+	}
+}
+
+func TestWriter_FlushIncomplete(t *testing.T) {
+	testCases := []struct {
+		charset  string
+		input    []byte
+		expected string
+	}{
+		// A dangling byte.
+		{"utf-16le", []byte{'a', 0, 'b'}, "a�"},
+		// A high surrogate without the low one.
+		{"utf-16be", []byte{0, 'a', 0xD8, 0x34}, "a�"},
+		{"utf-16be", []byte{0, 'a', 0xD8, 0x34, 0xDD}, "a�"},
+		// Nothing held back.
+		{"utf-16le", []byte{'a', 0}, "a"},
+	}
+
+	for _, tc := range testCases {
+		for chunk := 1; chunk <= len(tc.input); chunk++ {
+			if out := transcode(t, tc.charset, tc.input, chunk); out != tc.expected {
+				t.Errorf("%v %x, chunk %v: expected %q, got %q",
+					tc.charset, tc.input, chunk, tc.expected, out)
+			}
+		}
+	}
+}
+
+func TestWriter_InvalidSurrogate(t *testing.T) {
+	// A high surrogate followed by a regular character.
+	input := []byte{0x34, 0xD8, 'a', 0}
+	for chunk := 1; chunk <= len(input); chunk++ {
+		if out := transcode(t, "utf-16le", input, chunk); out != "�a" {
+			t.Errorf("chunk %v: expected %q, got %q", chunk, "�a", out)
+		}
+	}
+}
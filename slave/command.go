@@ -7,15 +7,22 @@ package slave
 
 import (
 	// Stdlib
+	"fmt"
 	"io"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
 	// Cider
+	"github.com/cider/cider/data"
+	"github.com/cider/cider/slave/charset"
+	"github.com/cider/cider/slave/runners"
 	"github.com/cider/cider/utils"
+	"github.com/cider/cider/utils/executil"
 
 	// Others
 	"code.google.com/p/go.net/websocket"
@@ -23,31 +30,215 @@ import (
 	"github.com/tchap/gocli"
 )
 
+// exitGaveUp is the exit code used when the slave gives up reconnecting.
+const exitGaveUp = 3
+
 var (
-	master      string
-	token       string
-	identity    string
-	labels      string
-	workspace   string
-	executors   = uint(runtime.NumCPU())
-	verboseMode bool
-	debugMode   bool
+	master       string
+	token        string
+	tokenFile    string
+	caFile       string
+	certFile     string
+	keyFile      string
+	identity     string
+	labels       string
+	workspace    string
+	executors    = uint(runtime.NumCPU())
+	inheritEnv   string
+	inheritAll   bool
+	maxRetries   uint
+	maxDownTime  time.Duration
+	maxBuildTime time.Duration
+	runnerTOs    = make(timeouts)
+	maxPulls     uint
+	secretsDir   string
+	charsetName  string
+	sharedObjs   bool
+	namespaceWS  bool
+	verifySrcs   bool
+	cleanSrcs    bool
+	loginShells  bool
+	cacheLimit   uint
+	wsLimit      uint
+	stopDelay    = 5 * time.Second
+	progressTick = defaultProgressInterval
+	idemWindow   = defaultIdempotencyWindow
+	buildLogs    string
+	logMaxFiles  = uint(100)
+	logMaxAge    time.Duration
+	baseEnv      = data.Env(make([]string, 0))
+	baseSecrets  = data.Env(make([]string, 0))
+	verboseMode  bool
+	debugMode    bool
 )
 
 var Command = &gocli.Command{
 	UsageLine: `
-  slave [-master=URL] [-token=TOKEN] [-identity=IDENTITY] [-labels=LABELS]
-        [-workspace=WORKSPACE] [-executors=EXECUTORS] [-verbose|-debug]`,
+  slave [-master=URL] [-token=TOKEN|-token-file=FILE] [-identity=IDENTITY]
+        [-ca-file=FILE] [-cert-file=FILE -key-file=FILE]
+        [-labels=LABELS]
+        [-workspace=WORKSPACE] [-namespace-workspace]
+        [-executors=EXECUTORS] [-inherit-env=KEYS] [-inherit-all-env]
+        [-base-env KEY=VALUE ...] [-base-env-secret KEY=BACKEND:REF ...]
+        [-max-reconnects=N] [-max-disconnected-time=DURATION]
+        [-max-build-time=DURATION] [-runner-timeout RUNNER=DURATION ...]
+        [-max-pulls=N] [-secrets=SECRETS]
+        [-output-charset=CHARSET] [-shared-objects] [-verify-sources]
+        [-clean]
+        [-cache-limit=MB] [-workspace-limit=N] [-login-shells]
+        [-stop-delay=DURATION] [-idempotency-window=DURATION]
+        [-progress-interval=DURATION]
+        [-build-logs=DIR] [-build-logs-max-files=N]
+        [-build-logs-max-age=DURATION]
+        [-verbose|-debug]`,
 	Short: "run a build slave",
 	Long: `
     Start a build slave and connect it to the specified master node.
 
+    Only a part of the environment of the slave process is passed on to
+    the build scripts, since the environment may contain secrets, e.g.
+    the master access token. These are the common variables needed to run
+    the usual tools, e.g. PATH, HOME, LANG or TMPDIR, and the variables
+    starting with CIDER_BUILD_. More variables can be passed on using
+    -inherit-env, which is a comma-separated list of variable names.
+    A trailing * matches any suffix, e.g. -inherit-env=GOPATH,JAVA_*.
+    Use -inherit-all-env to pass the whole environment on.
+
+    Variables can be exported for every build using -base-env, e.g. proxy
+    settings. The variables requested by the build override these, and these
+    override the environment of the slave process. -base-env-secret does the
+    same for secrets, which are resolved the same way as the secrets
+    requested by the builds and masked in the build output.
+
+    The master certificate is verified against the system certificate pool
+    unless -ca-file is set, e.g. to the ca.crt file generated by cider setup.
+    The client certificate is presented to the master when -cert-file and
+    -key-file are set.
+
+    The methods are exported for the slave identity as well as for LABELS,
+    so that the builds can be requested from a particular slave. IDENTITY
+    must not be used as a label by the other slaves.
+
+    The slave keeps reconnecting to the master node forever by default.
+    When -max-reconnects or -max-disconnected-time is set and the limit is
+    exceeded, the slave gives up and exits with exit code 3, so that it can be
+    rescheduled by the process supervisor.
+
+    The builds can request a timeout. The builds not requesting any timeout
+    get the default timeout of the runner, which can be set using
+    -runner-timeout, e.g. -runner-timeout bash=10m. The timeout is limited by
+    -max-build-time, longer timeouts are cut down to the maximum.
+
+    The builds can request secrets to be exported for the build scripts.
+    The secrets are read either from the CIDER_SECRET_<NAME> environment
+    variables of the slave process or from the files located in SECRETS.
+
+    The build output is expected to be UTF-8. In case the build tools emit
+    the output using a different charset, set CHARSET to have the output
+    transcoded before it is sent to the client. The supported charsets are
+    iso-8859-1, windows-1252, utf-16le and utf-16be.
+
+    The sources are checked out into WORKSPACE/HOST/PATH, where HOST and PATH
+    come from the repository URL. The svn repositories are checked out into
+    WORKSPACE/.cider-svn/HOST/PATH. The URL is normalized first, i.e. the host
+    is lowercased and the default port and the trailing .git are dropped.
+    The git sources checked out by the older slaves into the workspace of
+    the URL as it was are moved on the first build of the repository, or
+    removed in case the sources are checked out in both workspaces.
+
+    When -namespace-workspace is set, the slave uses WORKSPACE/IDENTITY as
+    its workspace, so that multiple slaves can share WORKSPACE, e.g. on
+    a network filesystem. The slaves do not share the shared object store
+    or the build caches then. IDENTITY must consist of letters, digits,
+    '.', '_' and '-' only.
+
+    When -shared-objects is set, the git workspaces share objects through a
+    common object store located in WORKSPACE. The objects are only pruned
+    from the store when -workspace-limit removes the sources of a workspace,
+    and only while no other workspace is in use. Use git gc --prune=never
+    when running gc on the store manually while the slave is running,
+    pruning can break the workspaces being checked out.
+
+    When -verify-sources is set, a checksum of the sources is recorded after
+    every build and verified before the next build of the same workspace.
+    When the sources do not match, e.g. because they have been tampered with,
+    they are cloned again. The checksum covers the checked out commit,
+    the changes to the tracked files, the names of the untracked files and
+    the git config and hooks, but not the contents of the untracked files.
+
+    When -workspace-limit is set, the sources of the least recently used
+    workspaces are removed once there are more than N workspaces with the
+    sources checked out. The workspaces being used by a build are never
+    touched. The sources are cloned again once the workspace is used again.
+
+    When -clean is set, the sources are removed before every build and
+    the repository is cloned again instead of being pulled, so that no files
+    are left behind by the previous builds. This makes the builds slower.
+    The builds can request a clean checkout using cider build -clean as well.
+
+    When -cache-limit is set, the build scripts can save and restore
+    directories across builds by printing the following lines to stdout:
+
+      ::cider:cache:save:KEY:PATH
+      ::cider:cache:restore:KEY:PATH
+
+    PATH is relative to SRCDIR. The save directives are processed once the
+    build script succeeds. The restore directives are remembered for the
+    workspace and processed before the build script is run in the following
+    builds, but only if PATH does not exist. The caches are kept in WORKSPACE,
+    separately for every workspace, so KEY only refers to the caches saved
+    by the builds of the same repository and branch. The least recently used
+    caches are removed once the total size exceeds the given number of
+    megabytes.
+
+    When -login-shells is set, the slave exports the bash-login runner as
+    well. The runner runs the script using bash --login, so the profile
+    of the user running the slave is sourced first. This makes the tools
+    set up in the profile available, e.g. nvm or rbenv, but the profile can
+    also change or override the variables exported for the build, including
+    PATH and the variables requested by the build, and it is executed for
+    every build. Enable this only when the profile is trusted.
+
+    When -build-logs is set, the output of every build is written into a file
+    located in DIR as well, so that it is available even when the client
+    disconnects. The files are named after the build start time, the client,
+    the request ID and the repository. Only the last N files are kept, 100
+    by default, and the files older than -build-logs-max-age are removed.
+    Zero means no limit. The build logs contain the output as sent to
+    the client, i.e. with the secrets masked, except for the artifacts.
+
+    The builds can be requested with an idempotency key. The requests
+    repeating the key of a running build are attached to it, the requests
+    repeating the key of a finished build get its result, but only within
+    the time set using -idempotency-window. A zero window means that only
+    the running builds are shared. The requests repeating the key for
+    a different build are rejected with return code 11.
+
+    When a build is interrupted, the build script is sent SIGINT, then SIGTERM
+    and finally SIGKILL, waiting for DURATION after each of the signals
+    for the script to exit. On Windows the script is killed right away.
+
+    While pulling the sources and running the build script, the slave
+    signals progress to the client every -progress-interval, 10 seconds by
+    default, so that the client knows the build is alive even when there is
+    no output. Zero disables the progress signals.
+
   ENVIRONMENT:
     CIDER_MASTER_URL
     CIDER_MASTER_TOKEN
+    CIDER_MASTER_TOKEN_FILE
+    CIDER_MASTER_CA_FILE
+    CIDER_MASTER_CERT_FILE
+    CIDER_MASTER_KEY_FILE
     CIDER_SLAVE_IDENTITY
     CIDER_SLAVE_LABELS
+    CIDER_SLAVE_INHERIT_ENV
     CIDER_SLAVE_WORKSPACE
+    CIDER_SLAVE_MAX_PULLS
+    CIDER_SLAVE_SECRETS
+    CIDER_SLAVE_OUTPUT_CHARSET
+    CIDER_SLAVE_CACHE_LIMIT
+    CIDER_SLAVE_BUILD_LOGS
 	`,
 	Action: enslaveThisPoorMachine,
 }
@@ -56,10 +247,56 @@ func init() {
 	cmd := Command
 	cmd.Flags.StringVar(&master, "master", master, "build master to connect to")
 	cmd.Flags.StringVar(&token, "token", token, "build master access token")
+	cmd.Flags.StringVar(&tokenFile, "token-file", tokenFile, "file to read the build master access token from")
+	cmd.Flags.StringVar(&caFile, "ca-file", caFile, "certificate authority to verify the build master with")
+	cmd.Flags.StringVar(&certFile, "cert-file", certFile, "client certificate to present to the build master")
+	cmd.Flags.StringVar(&keyFile, "key-file", keyFile, "client certificate key")
 	cmd.Flags.StringVar(&identity, "identity", identity, "build slave identity; must be unique")
 	cmd.Flags.StringVar(&labels, "labels", labels, "labels to apply to this slave")
 	cmd.Flags.StringVar(&workspace, "workspace", workspace, "build workspace")
+	cmd.Flags.BoolVar(&namespaceWS, "namespace-workspace", namespaceWS,
+		"use a subdirectory of the workspace named after the slave identity")
 	cmd.Flags.UintVar(&executors, "executors", executors, "number of jobs that can run in parallel")
+	cmd.Flags.StringVar(&inheritEnv, "inherit-env", inheritEnv,
+		"environment variables to pass on to the build scripts")
+	cmd.Flags.BoolVar(&inheritAll, "inherit-all-env", inheritAll,
+		"pass the whole environment on to the build scripts")
+	cmd.Flags.Var(&baseEnv, "base-env", "define an environment variable for every build")
+	cmd.Flags.Var(&baseSecrets, "base-env-secret", "define an environment variable resolved from a secret for every build")
+	cmd.Flags.UintVar(&maxRetries, "max-reconnects", maxRetries,
+		"give up after this many failed reconnects in a row; 0 means never")
+	cmd.Flags.DurationVar(&maxDownTime, "max-disconnected-time", maxDownTime,
+		"give up after being disconnected for this long; 0 means never")
+	cmd.Flags.DurationVar(&maxBuildTime, "max-build-time", maxBuildTime,
+		"maximum time a build script can run; 0 means no limit")
+	cmd.Flags.Var(runnerTOs, "runner-timeout", "default build timeout for the given runner")
+	cmd.Flags.UintVar(&maxPulls, "max-pulls", maxPulls,
+		"maximum number of VCS operations running in parallel; 0 means no limit")
+	cmd.Flags.StringVar(&secretsDir, "secrets", secretsDir, "directory containing build secrets")
+	cmd.Flags.StringVar(&charsetName, "output-charset", charsetName, "charset of the build output")
+	cmd.Flags.BoolVar(&sharedObjs, "shared-objects", sharedObjs,
+		"share git objects between the workspaces")
+	cmd.Flags.BoolVar(&verifySrcs, "verify-sources", verifySrcs,
+		"detect the sources being modified between the builds")
+	cmd.Flags.BoolVar(&cleanSrcs, "clean", cleanSrcs,
+		"clone the repository again for every build instead of pulling")
+	cmd.Flags.BoolVar(&loginShells, "login-shells", loginShells,
+		"export the runners that run the scripts through a login shell")
+	cmd.Flags.UintVar(&cacheLimit, "cache-limit", cacheLimit,
+		"maximum size of the build cache in megabytes; 0 disables the cache")
+	cmd.Flags.UintVar(&wsLimit, "workspace-limit", wsLimit,
+		"maximum number of workspaces with the sources checked out; 0 means no limit")
+	cmd.Flags.DurationVar(&stopDelay, "stop-delay", stopDelay,
+		"time given to an interrupted build script to exit before escalating")
+	cmd.Flags.DurationVar(&progressTick, "progress-interval", progressTick,
+		"how often to signal build progress while pulling and running the script; 0 disables")
+	cmd.Flags.DurationVar(&idemWindow, "idempotency-window", idemWindow,
+		"how long the results of the builds with an idempotency key are kept")
+	cmd.Flags.StringVar(&buildLogs, "build-logs", buildLogs, "directory to write the build output into")
+	cmd.Flags.UintVar(&logMaxFiles, "build-logs-max-files", logMaxFiles,
+		"maximum number of build logs kept; 0 means no limit")
+	cmd.Flags.DurationVar(&logMaxAge, "build-logs-max-age", logMaxAge,
+		"maximum age of the build logs kept; 0 means no limit")
 	cmd.Flags.BoolVar(&verboseMode, "verbose", verboseMode, "print verbose log output to the console")
 	cmd.Flags.BoolVar(&debugMode, "debug", debugMode, "print debug log output to the console")
 }
@@ -73,10 +310,19 @@ func enslaveThisPoorMachine(cmd *gocli.Command, args []string) {
 
 	// Read the environment to fill in missing parameters.
 	utils.GetenvOrFailNow(&master, "CIDER_MASTER_URL", cmd)
-	utils.GetenvOrFailNow(&token, "CIDER_MASTER_TOKEN", cmd)
+	utils.GetTokenOrFailNow(&token, tokenFile, "CIDER_MASTER_TOKEN", cmd)
+	utils.Getenv(&caFile, "CIDER_MASTER_CA_FILE")
+	utils.Getenv(&certFile, "CIDER_MASTER_CERT_FILE")
+	utils.Getenv(&keyFile, "CIDER_MASTER_KEY_FILE")
 	utils.GetenvOrFailNow(&identity, "CIDER_SLAVE_IDENTITY", cmd)
 	utils.Getenv(&labels, "CIDER_SLAVE_LABELS")
+	utils.Getenv(&inheritEnv, "CIDER_SLAVE_INHERIT_ENV")
 	utils.GetenvOrFailNow(&workspace, "CIDER_SLAVE_WORKSPACE", cmd)
+	utils.GetenvUint(&maxPulls, "CIDER_SLAVE_MAX_PULLS", cmd)
+	utils.Getenv(&secretsDir, "CIDER_SLAVE_SECRETS")
+	utils.Getenv(&charsetName, "CIDER_SLAVE_OUTPUT_CHARSET")
+	utils.GetenvUint(&cacheLimit, "CIDER_SLAVE_CACHE_LIMIT", cmd)
+	utils.Getenv(&buildLogs, "CIDER_SLAVE_BUILD_LOGS")
 
 	// Set up logging.
 	var (
@@ -98,21 +344,72 @@ func enslaveThisPoorMachine(cmd *gocli.Command, args []string) {
 		panic(err)
 	}
 
+	// Warn about the timeouts set for unknown runners. The runner can be just
+	// unavailable on this machine, so this is not treated as an error.
+	for name := range runnerTOs {
+		if !runnerAvailable(name) {
+			log.Warnf("Runner %v is not available, ignoring its default timeout", name)
+		}
+	}
+
+	// Make sure the output charset is supported.
+	if err := charset.Validate(charsetName); err != nil {
+		die(err)
+	}
+
+	// Load the TLS configuration.
+	tlsConfig, err := utils.LoadTLSConfig(caFile, certFile, keyFile)
+	if err != nil {
+		die(err)
+	}
+
 	// Start the slave loop. This loop takes care of reconnecting to the master
 	// node once the slave is disconnected. It does exponential backoff.
 	var (
 		slave    *BuildSlave
-		backoff  = minBackoff
+		backoff  = NewBackoff(minBackoff, maxBackoff)
 		signalCh = make(chan os.Signal, 1)
+
+		// Failed reconnects in a row and the time of the last disconnect.
+		numFailures   uint
+		disconnectedT = time.Now()
 	)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 	for {
-		if slave != nil {
-			if err := slave.Terminate(); err != nil {
+		previous := slave
+		if previous != nil {
+			if err := previous.Terminate(); err != nil {
 				die(err)
 			}
 		}
 		slave = New(identity, workspace, executors)
+		slave.InheritEnv = inheritedEnvKeys()
+		slave.InheritAllEnv = inheritAll
+		slave.BaseEnv = baseEnv
+		slave.BaseSecrets = baseSecrets
+		slave.MaxBuildTime = maxBuildTime
+		slave.RunnerTimeouts = runnerTOs
+		slave.MaxConcurrentPulls = maxPulls
+		slave.SecretsDir = secretsDir
+		slave.OutputCharset = charsetName
+		slave.SharedObjects = sharedObjs
+		slave.NamespaceWorkspace = namespaceWS
+		slave.VerifySources = verifySrcs
+		slave.CleanCheckout = cleanSrcs
+		slave.LoginShells = loginShells
+		slave.CacheLimit = int64(cacheLimit) << 20
+		slave.WorkspaceLimit = wsLimit
+		slave.StopPolicy = executil.NewDefaultPolicy(stopDelay)
+		slave.IdempotencyWindow = idemWindow
+		slave.ProgressInterval = progressTick
+		slave.BuildLogDir = buildLogs
+		slave.BuildLogMaxFiles = int(logMaxFiles)
+		slave.BuildLogMaxAge = logMaxAge
+		slave.TLSConfig = tlsConfig
+		// The build statistics and the idempotency keys survive reconnects.
+		if previous != nil {
+			slave.TakeOver(previous)
+		}
 		go func() {
 			select {
 			case <-slave.Terminated():
@@ -130,6 +427,8 @@ func enslaveThisPoorMachine(cmd *gocli.Command, args []string) {
 
 		// EOF means disconnect. That is fine, we will try to reconnect.
 		case err == io.EOF:
+			numFailures = 0
+			disconnectedT = time.Now()
 
 		// Nil error means a clean termination, in which case we just return.
 		case err == nil:
@@ -144,6 +443,7 @@ func enslaveThisPoorMachine(cmd *gocli.Command, args []string) {
 			if ex, ok := err.(*websocket.DialError); ok {
 				if ex.Err.Error() == "bad status" {
 					log.Warn(err)
+					numFailures++
 					break
 				}
 			}
@@ -152,23 +452,80 @@ func enslaveThisPoorMachine(cmd *gocli.Command, args []string) {
 			die(err)
 		}
 
+		// Give up in case the reconnect limits are exceeded.
+		if maxRetries != 0 && numFailures >= maxRetries {
+			giveUp("Failed to reconnect %v times in a row, giving up", numFailures)
+		}
+		if maxDownTime != 0 && time.Now().Sub(disconnectedT) > maxDownTime {
+			giveUp("Disconnected for more than %v, giving up", maxDownTime)
+		}
+
 		// Reset the backoff in case we were connected for some time.
 		if time.Now().Sub(connectT) > maxBackoff {
-			backoff = minBackoff
+			backoff.Reset()
 		}
 
-		// Do exponential backoff.
-		log.Infof("Waiting for %v before reconnecting...", backoff)
-		time.Sleep(backoff)
-		backoff = 2 * backoff
-		if backoff > maxBackoff {
-			backoff = maxBackoff
-		}
+		// Do exponential backoff, coordinated with other slaves in the process.
+		DefaultReconnectCoordinator.Wait(backoff.Next(), nil)
 	}
 }
 
+func giveUp(format string, params ...interface{}) {
+	log.Errorf(format, params...)
+	log.Flush()
+	os.Exit(exitGaveUp)
+}
+
 func die(err error) {
 	log.Critical(err)
 	log.Flush()
 	os.Exit(1)
 }
+
+// inheritedEnvKeys splits the -inherit-env list, skipping empty items.
+func inheritedEnvKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(inheritEnv, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func runnerAvailable(name string) bool {
+	for _, runner := range runners.Available {
+		if runner.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// timeouts is a flag.Value mapping runner names to build timeouts.
+type timeouts map[string]time.Duration
+
+func (tos timeouts) Set(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid runner timeout: %v", kv)
+	}
+	timeout, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return err
+	}
+	if timeout < 0 {
+		return fmt.Errorf("negative runner timeout: %v", kv)
+	}
+	tos[parts[0]] = timeout
+	return nil
+}
+
+func (tos timeouts) String() string {
+	kvs := make([]string, 0, len(tos))
+	for name, timeout := range tos {
+		kvs = append(kvs, name+"="+timeout.String())
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	"runtime"
+	"strings"
+)
+
+// DefaultInheritedEnv contains the environment variables of the slave process
+// that are passed on to the build scripts by default. These are needed to run
+// the usual tools and they are not expected to contain any secrets.
+var DefaultInheritedEnv = []string{
+	// Unix
+	"PATH",
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"SHELL",
+	"LANG",
+	"LANGUAGE",
+	"LC_*",
+	"TZ",
+	"TMPDIR",
+	"TERM",
+
+	// Windows
+	"SYSTEMROOT",
+	"SYSTEMDRIVE",
+	"WINDIR",
+	"COMSPEC",
+	"PATHEXT",
+	"TEMP",
+	"TMP",
+	"USERNAME",
+	"USERPROFILE",
+	"HOMEDRIVE",
+	"HOMEPATH",
+	"APPDATA",
+	"LOCALAPPDATA",
+	"PROGRAMDATA",
+	"PROGRAMFILES",
+	"PROGRAMFILES(X86)",
+	"COMMONPROGRAMFILES",
+	"NUMBER_OF_PROCESSORS",
+	"PROCESSOR_ARCHITECTURE",
+	"OS",
+}
+
+// BuildEnvPrefix is the prefix of the slave environment variables that are
+// always passed on to the build scripts. This is the way to export
+// a variable for the builds without changing the slave configuration.
+const BuildEnvPrefix = "CIDER_BUILD_"
+
+// filterEnv returns the KEY=VALUE pairs from env that are passed on to
+// the build scripts, i.e. the variables listed in DefaultInheritedEnv or in
+// extra and the variables starting with BuildEnvPrefix. A trailing * in
+// the lists matches any suffix. The keys are case-insensitive on Windows.
+func filterEnv(env []string, extra []string) []string {
+	patterns := make([]string, 0, len(DefaultInheritedEnv)+len(extra)+1)
+	for _, pattern := range append(append(patterns, DefaultInheritedEnv...), extra...) {
+		patterns = append(patterns, normalizeEnvKey(pattern))
+	}
+	patterns = append(patterns, normalizeEnvKey(BuildEnvPrefix+"*"))
+
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		key := normalizeEnvKey(strings.SplitN(kv, "=", 2)[0])
+		for _, pattern := range patterns {
+			if matchEnvKey(pattern, key) {
+				filtered = append(filtered, kv)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func matchEnvKey(pattern, key string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(key, pattern[:len(pattern)-1])
+	}
+	return key == pattern
+}
+
+func normalizeEnvKey(key string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(key)
+	}
+	return key
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	// Cider
+	"github.com/cider/cider/data"
+
+	// Meeko
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+)
+
+const defaultIdempotencyWindow = 10 * time.Minute
+
+// buildRecord is a build started with an idempotency key.
+type buildRecord struct {
+	fingerprint string
+	// artifactsTag is the tag of the artifacts frames sent by the owner.
+	artifactsTag string
+	stdout       *fanOutWriter
+	stderr       *fanOutWriter
+
+	// code and value are set before done is closed.
+	done  chan struct{}
+	code  rpc.ReturnCode
+	value interface{}
+}
+
+// buildRegistry keeps track of the builds started with an idempotency key,
+// so that the requests repeating the key can attach to the existing build.
+// The finished builds are kept for window.
+type buildRegistry struct {
+	window  time.Duration
+	records map[string]*buildRecord
+	mu      *sync.Mutex
+}
+
+func newBuildRegistry(window time.Duration) *buildRegistry {
+	return &buildRegistry{
+		window:  window,
+		records: make(map[string]*buildRecord),
+		mu:      new(sync.Mutex),
+	}
+}
+
+// begin returns the record for the given key. owner is set when there was
+// no record yet, a new one is created for the request then. The owner is
+// supposed to run the build and resolve the request returned, which is
+// request wrapped so that the output and the result are shared.
+func (registry *buildRegistry) begin(key, fingerprint, artifactsTag string, request rpc.RemoteRequest) (
+	record *buildRecord, owner rpc.RemoteRequest) {
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if record, ok := registry.records[key]; ok {
+		return record, nil
+	}
+
+	record = &buildRecord{
+		fingerprint:  fingerprint,
+		artifactsTag: artifactsTag,
+		stdout:       newFanOutWriter(request.Stdout()),
+		stderr:       newFanOutWriter(request.Stderr()),
+		done:         make(chan struct{}),
+	}
+	registry.records[key] = record
+	return record, &sharedRequest{request, registry, key, record}
+}
+
+// finish marks the build as finished and schedules the record for removal.
+// The builds interrupted while queued have not run at all, so these are
+// forgotten right away and the key can be used to start the build again.
+// This includes the builds interrupted while waiting for a VCS slot.
+func (registry *buildRegistry) finish(key string, record *buildRecord, code rpc.ReturnCode, value interface{}) {
+	record.code = code
+	record.value = value
+	close(record.done)
+
+	remove := func() {
+		registry.mu.Lock()
+		if registry.records[key] == record {
+			delete(registry.records, key)
+		}
+		registry.mu.Unlock()
+	}
+	if registry.window == 0 || code == 5 || code == 12 {
+		remove()
+		return
+	}
+	time.AfterFunc(registry.window, remove)
+}
+
+// buildFingerprint identifies the build requested, no matter the key.
+// Repeating a key is only allowed for the same build. The artifacts tag is
+// chosen by every client separately, so it is not a part of the fingerprint.
+func buildFingerprint(runner string, args *data.BuildArgs) string {
+	argsCopy := *args
+	argsCopy.IdempotencyKey = ""
+	argsCopy.ArtifactsTag = ""
+	hash := sha256.New()
+	io.WriteString(hash, runner+"\n")
+	json.NewEncoder(hash).Encode(&argsCopy)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// sharedRequest is the request of the build owner. The output is copied to
+// the requests attached to the build and the result is recorded for them.
+type sharedRequest struct {
+	rpc.RemoteRequest
+	registry *buildRegistry
+	key      string
+	record   *buildRecord
+}
+
+func (request *sharedRequest) Stdout() io.Writer {
+	return request.record.stdout
+}
+
+func (request *sharedRequest) Stderr() io.Writer {
+	return request.record.stderr
+}
+
+func (request *sharedRequest) Resolve(code rpc.ReturnCode, value interface{}) error {
+	request.registry.finish(request.key, request.record, code, value)
+	return request.RemoteRequest.Resolve(code, value)
+}
+
+// fanOutWriter writes into the underlying writer and into all the writers
+// attached. The errors returned by the attached writers are ignored.
+type fanOutWriter struct {
+	w        io.Writer
+	attached map[int]io.Writer
+	nextID   int
+	mu       *sync.Mutex
+}
+
+func newFanOutWriter(w io.Writer) *fanOutWriter {
+	return &fanOutWriter{
+		w:        w,
+		attached: make(map[int]io.Writer),
+		mu:       new(sync.Mutex),
+	}
+}
+
+func (fw *fanOutWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	for _, w := range fw.attached {
+		w.Write(p)
+	}
+	return fw.w.Write(p)
+}
+
+// attach starts copying the output into w, until detach is called.
+func (fw *fanOutWriter) attach(w io.Writer) (detach func()) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	id := fw.nextID
+	fw.nextID++
+	fw.attached[id] = w
+	return func() {
+		fw.mu.Lock()
+		delete(fw.attached, id)
+		fw.mu.Unlock()
+	}
+}
+
+// attach resolves the request with the result of the build recorded, waiting
+// for the build to finish first. The output of the build is copied to
+// the request in the meantime. Interrupting the request does not interrupt
+// the build, the request is just detached.
+func (builder *Builder) attach(request rpc.RemoteRequest, record *buildRecord, args *data.BuildArgs) {
+	if record.fingerprint != buildFingerprint(builder.runner.Name, args) {
+		request.Resolve(11, builder.newResult(
+			"idempotency key already used for a different build"))
+		return
+	}
+
+	select {
+	case <-record.done:
+		fmt.Fprintln(request.Stdout(), "---> Returning the result of the build with the same idempotency key")
+		// The artifacts are not kept once sent, let the client know
+		// instead of leaving it waiting for the frames.
+		if len(args.Artifacts) != 0 && args.ArtifactsTag != "" {
+			io.WriteString(request.Stdout(), data.FormatArtifactsFrame(args.ArtifactsTag, data.ArtifactsError,
+				[]byte("the artifacts of a finished build cannot be sent again")))
+		}
+		request.Resolve(record.code, record.value)
+		return
+	default:
+	}
+
+	fmt.Fprintln(request.Stdout(), "---> Attaching to the running build with the same idempotency key")
+	stdout := request.Stdout()
+	if record.artifactsTag != "" && args.ArtifactsTag != "" && record.artifactsTag != args.ArtifactsTag {
+		rw := newRetagWriter(stdout, record.artifactsTag, args.ArtifactsTag)
+		defer rw.Flush()
+		stdout = rw
+	}
+	detachStdout := record.stdout.attach(stdout)
+	detachStderr := record.stderr.attach(request.Stderr())
+	defer detachStderr()
+	defer detachStdout()
+
+	select {
+	case <-record.done:
+		request.Resolve(record.code, record.value)
+	case <-request.Interrupted():
+		request.Resolve(5, builder.newResult("interrupted while attached to another build"))
+	}
+}
+
+// retagWriter rewrites the artifacts frames carrying one tag so that they
+// carry another tag. The frames sent by the build owner are copied to
+// the attached requests this way, every client only accepts its own tag.
+type retagWriter struct {
+	w         io.Writer
+	from      []byte
+	to        []byte
+	lineStart bool
+	pending   []byte
+}
+
+func newRetagWriter(w io.Writer, from, to string) *retagWriter {
+	return &retagWriter{
+		w:         w,
+		from:      []byte(data.ArtifactsPrefix + from + ":"),
+		to:        []byte(data.ArtifactsPrefix + to + ":"),
+		lineStart: true,
+	}
+}
+
+func (rw *retagWriter) Write(p []byte) (int, error) {
+	buf := append(rw.pending, p...)
+	rw.pending = nil
+
+	for len(buf) != 0 {
+		if rw.lineStart {
+			// Wait for more data in case the line can still be a frame.
+			if len(buf) < len(rw.from) && bytes.HasPrefix(rw.from, buf) {
+				rw.pending = buf
+				return len(p), nil
+			}
+			if bytes.HasPrefix(buf, rw.from) {
+				if _, err := rw.w.Write(rw.to); err != nil {
+					return 0, err
+				}
+				buf = buf[len(rw.from):]
+				rw.lineStart = false
+				continue
+			}
+		}
+
+		end := len(buf)
+		if i := bytes.IndexByte(buf, '\n'); i != -1 {
+			end = i + 1
+		}
+		if _, err := rw.w.Write(buf[:end]); err != nil {
+			return 0, err
+		}
+		rw.lineStart = buf[end-1] == '\n'
+		buf = buf[end:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the data held back while waiting for the rest of a line.
+func (rw *retagWriter) Flush() error {
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(rw.pending)
+	rw.pending = nil
+	return err
+}
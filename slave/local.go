@@ -0,0 +1,138 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	// Cider
+	"github.com/cider/cider/data"
+	"github.com/cider/cider/slave/runners"
+
+	// Meeko
+	"github.com/meeko/go-meeko/meeko/services/rpc"
+	"github.com/meeko/go-meeko/meeko/utils/codecs"
+)
+
+// LocalSender is the sender of the builds run using BuildSlave.Run.
+const LocalSender = "local"
+
+var errAlreadyResolved = errors.New("request already resolved")
+
+// Run runs a single build in the current process, without connecting to any
+// build master. The build is processed the same way as the builds requested
+// remotely, the slave configuration applies as well. The output is written
+// into stdout and stderr, the build is interrupted once interrupted is closed.
+func (slave *BuildSlave) Run(runner string, args *data.BuildArgs,
+	stdout, stderr io.Writer, interrupted <-chan struct{}) (rpc.ReturnCode, *data.BuildResult, error) {
+
+	var selected *runners.Runner
+	for _, r := range slave.runners() {
+		if r.Name == runner {
+			selected = r
+			break
+		}
+	}
+	if selected == nil {
+		return 0, nil, fmt.Errorf("runner not available: %v", runner)
+	}
+
+	shared, err := slave.prepare()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	request, err := newLocalRequest(fmt.Sprintf("cider.%v.%v", LocalSender, runner),
+		args, stdout, stderr, interrupted)
+	if err != nil {
+		return 0, nil, err
+	}
+	slave.newBuilder(selected, shared).Build(request)
+	return request.code, request.result, nil
+}
+
+// localRequest is a build request that does not come over the network.
+// The arguments are encoded the same way the transport encodes them.
+type localRequest struct {
+	method      string
+	args        []byte
+	stdout      io.Writer
+	stderr      io.Writer
+	interrupted <-chan struct{}
+
+	code       rpc.ReturnCode
+	result     *data.BuildResult
+	resolvedCh chan struct{}
+}
+
+func newLocalRequest(method string, args *data.BuildArgs,
+	stdout, stderr io.Writer, interrupted <-chan struct{}) (*localRequest, error) {
+
+	var buf bytes.Buffer
+	if err := codecs.MessagePack.Encode(&buf, args); err != nil {
+		return nil, err
+	}
+	return &localRequest{
+		method:      method,
+		args:        buf.Bytes(),
+		stdout:      stdout,
+		stderr:      stderr,
+		interrupted: interrupted,
+		resolvedCh:  make(chan struct{}),
+	}, nil
+}
+
+func (request *localRequest) Sender() string {
+	return LocalSender
+}
+
+func (request *localRequest) Id() rpc.RequestID {
+	return 0
+}
+
+func (request *localRequest) Method() string {
+	return request.method
+}
+
+func (request *localRequest) UnmarshalArgs(dst interface{}) error {
+	return codecs.MessagePack.Decode(bytes.NewReader(request.args), dst)
+}
+
+func (request *localRequest) SignalProgress() error {
+	return nil
+}
+
+func (request *localRequest) Stdout() io.Writer {
+	return request.stdout
+}
+
+func (request *localRequest) Stderr() io.Writer {
+	return request.stderr
+}
+
+func (request *localRequest) Interrupted() <-chan struct{} {
+	return request.interrupted
+}
+
+func (request *localRequest) Resolve(code rpc.ReturnCode, value interface{}) error {
+	select {
+	case <-request.resolvedCh:
+		return errAlreadyResolved
+	default:
+	}
+	request.code = code
+	request.result, _ = value.(*data.BuildResult)
+	close(request.resolvedCh)
+	return nil
+}
+
+func (request *localRequest) Resolved() <-chan struct{} {
+	return request.resolvedCh
+}
@@ -6,17 +6,55 @@
 package slave
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/cider/cider/slave/cache"
+	"github.com/cider/cider/vcs"
+
+	log "github.com/cihub/seelog"
 )
 
+// objectStoreDir is the directory within the workspace root that contains
+// the git object store shared by all the workspaces, if enabled.
+const objectStoreDir = ".cider-objects"
+
+// cacheDir is the directory within the workspace root that contains the build
+// caches, if enabled.
+const cacheDir = ".cider-cache"
+
+// svnWorkspaceDir is the directory within the workspace root that contains
+// the svn workspaces, so that they cannot collide with the git workspaces.
+// The git workspaces are located in the workspace root directly as they
+// always have been.
+const svnWorkspaceDir = ".cider-svn"
+
+// cacheRestoreList is the file within the project workspace that remembers
+// the cache restore directives emitted by the last successful build.
+const cacheRestoreList = "cache-restore"
+
+// sourceChecksum is the file within the project workspace that contains
+// the checksum of the sources recorded after the last build.
+const sourceChecksum = "src.checksum"
+
 type WorkspaceManager struct {
-	root   string
-	queues map[string]chan bool
-	mu     *sync.Mutex
+	root    string
+	queues  map[string]chan bool
+	objects *vcs.ObjectStore
+	cache   *cache.Cache
+	limit   int
+	used    map[string]time.Time
+	mu      *sync.Mutex
 }
 
 func newWorkspaceManager(root string) *WorkspaceManager {
@@ -27,6 +65,265 @@ func newWorkspaceManager(root string) *WorkspaceManager {
 	}
 }
 
+// EnableObjectStore makes the workspaces share git objects through a common
+// object store located in the workspace root.
+func (wm *WorkspaceManager) EnableObjectStore() error {
+	store, err := vcs.OpenObjectStore(filepath.Join(wm.root, objectStoreDir))
+	if err != nil {
+		return err
+	}
+	wm.objects = store
+	return nil
+}
+
+// ObjectStore returns the shared object store, nil when it is not enabled.
+func (wm *WorkspaceManager) ObjectStore() *vcs.ObjectStore {
+	return wm.objects
+}
+
+// ImportObjects imports the objects from the workspace sources into the shared
+// object store, so that they can be used by other workspaces. Only git
+// sources are imported.
+func (wm *WorkspaceManager) ImportObjects(workspace string) error {
+	if wm.objects == nil {
+		return nil
+	}
+	if exists, _ := checkDirectoryExists(filepath.Join(wm.SrcDir(workspace), ".git")); !exists {
+		return nil
+	}
+	return wm.objects.Import(wm.SrcDir(workspace), workspaceID(workspace))
+}
+
+// workspaceID returns the name identifying the workspace data kept outside of
+// the workspace, i.e. the objects in the shared object store and the caches.
+func workspaceID(workspace string) string {
+	sum := sha1.Sum([]byte(workspace))
+	return hex.EncodeToString(sum[:])
+}
+
+// removeObjects deletes the refs of the removed workspace from the shared
+// object store and prunes the store. The caller must hold the workspace queue.
+// The store is only pruned while no other workspace is locked, except for
+// current, which is locked by the caller, but it is not being checked out yet.
+// Otherwise the objects borrowed by a running checkout could be pruned.
+// The objects are pruned next time then.
+func (wm *WorkspaceManager) removeObjects(workspace, current string) error {
+	if wm.objects == nil {
+		return nil
+	}
+	removed, err := wm.objects.Remove(workspaceID(workspace))
+	if err != nil || !removed {
+		return err
+	}
+
+	// wm.mu is held until the store is pruned, so that no new workspace
+	// queue can be created meanwhile.
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	var held []chan bool
+	defer func() {
+		for _, q := range held {
+			<-q
+		}
+	}()
+	for ws, q := range wm.queues {
+		if ws == workspace || ws == current {
+			continue
+		}
+		select {
+		case q <- true:
+			held = append(held, q)
+		default:
+			log.Debugf("Workspace %v is in use, not pruning the shared object store", ws)
+			return nil
+		}
+	}
+
+	log.Info("Pruning the shared object store")
+	return wm.objects.Prune()
+}
+
+// EnableCache enables the build caches controlled by the build scripts.
+// limit is the maximum total size of the caches in bytes.
+func (wm *WorkspaceManager) EnableCache(limit int64) error {
+	c, err := cache.Open(filepath.Join(wm.root, cacheDir), limit)
+	if err != nil {
+		return err
+	}
+	wm.cache = c
+	return nil
+}
+
+// Cache returns the build cache of the given workspace, nil when it is not
+// enabled. Every workspace has its own cache keys.
+func (wm *WorkspaceManager) Cache(workspace string) (*cache.Cache, error) {
+	if wm.cache == nil {
+		return nil, nil
+	}
+	return wm.cache.Namespace(workspaceID(workspace))
+}
+
+// CacheRestoreList returns the path of the file that remembers the cache
+// restore directives for the given workspace.
+func (wm *WorkspaceManager) CacheRestoreList(workspace string) string {
+	return filepath.Join(workspace, cacheRestoreList)
+}
+
+// EnableWorkspaceLimit limits the number of workspaces with the sources
+// checked out. The sources of the least recently used workspaces are removed
+// once there are more than limit of them, see UseWorkspace. The workspaces
+// already present in the workspace root are taken into account.
+func (wm *WorkspaceManager) EnableWorkspaceLimit(limit int) error {
+	used := make(map[string]time.Time)
+	err := filepath.Walk(wm.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if filepath.Dir(path) == wm.root && strings.HasPrefix(info.Name(), ".cider-") &&
+			info.Name() != svnWorkspaceDir {
+			return filepath.SkipDir
+		}
+		if info.Name() != "src" {
+			return nil
+		}
+		// Only the directories containing a repository are the sources,
+		// the repository path itself may contain src.
+		gitExists, _ := checkDirectoryExists(filepath.Join(path, ".git"))
+		svnExists, _ := checkDirectoryExists(filepath.Join(path, ".svn"))
+		if !gitExists && !svnExists {
+			return nil
+		}
+		ws := filepath.Dir(path)
+		wsInfo, err := os.Stat(ws)
+		if err != nil {
+			return err
+		}
+		used[ws] = wsInfo.ModTime()
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan workspace %v: %v", wm.root, err)
+	}
+
+	wm.mu.Lock()
+	wm.limit = limit
+	wm.used = used
+	wm.mu.Unlock()
+	return wm.evict("")
+}
+
+// UseWorkspace marks the workspace as the most recently used one and removes
+// the sources of the least recently used workspaces exceeding the limit.
+// The caller is supposed to hold the workspace queue. The workspaces with
+// the queue held are never touched, so the limit can be exceeded temporarily.
+func (wm *WorkspaceManager) UseWorkspace(workspace string) error {
+	wm.mu.Lock()
+	if wm.limit == 0 {
+		wm.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	wm.used[workspace] = now
+	wm.mu.Unlock()
+
+	// The modification time is used to restore the order on restart.
+	os.Chtimes(workspace, now, now)
+	return wm.evict(workspace)
+}
+
+// evict removes the sources of the least recently used workspaces until
+// the limit is satisfied, skipping current and the workspaces in use.
+func (wm *WorkspaceManager) evict(current string) error {
+	for {
+		wm.mu.Lock()
+		if wm.limit == 0 || len(wm.used) <= wm.limit {
+			wm.mu.Unlock()
+			return nil
+		}
+
+		candidates := make([]string, 0, len(wm.used))
+		for ws := range wm.used {
+			if ws != current {
+				candidates = append(candidates, ws)
+			}
+		}
+		sort.Sort(byTime{candidates, wm.used})
+
+		// Take the workspace queue so that no build can start meanwhile.
+		var (
+			victim string
+			queue  chan bool
+		)
+		for _, ws := range candidates {
+			q, ok := wm.queues[ws]
+			if !ok {
+				q = make(chan bool, 1)
+				wm.queues[ws] = q
+			}
+			select {
+			case q <- true:
+				victim, queue = ws, q
+			default:
+				continue
+			}
+			break
+		}
+		if victim == "" {
+			wm.mu.Unlock()
+			return nil
+		}
+		delete(wm.used, victim)
+		wm.mu.Unlock()
+
+		log.Infof("Removing the sources of the least recently used workspace %v", victim)
+		err := os.RemoveAll(wm.SrcDir(victim))
+		if err == nil {
+			err = wm.SetSourceChecksum(victim, "")
+		}
+		if err != nil {
+			<-queue
+			return fmt.Errorf("failed to remove the sources of workspace %v: %v", victim, err)
+		}
+		err = wm.removeObjects(victim, current)
+		<-queue
+		if err != nil {
+			return fmt.Errorf("failed to remove the objects of workspace %v: %v", victim, err)
+		}
+	}
+}
+
+// byTime sorts the workspaces by the time of the last use, oldest first.
+type byTime struct {
+	workspaces []string
+	used       map[string]time.Time
+}
+
+func (s byTime) Len() int { return len(s.workspaces) }
+func (s byTime) Less(i, j int) bool {
+	return s.used[s.workspaces[i]].Before(s.used[s.workspaces[j]])
+}
+func (s byTime) Swap(i, j int) {
+	s.workspaces[i], s.workspaces[j] = s.workspaces[j], s.workspaces[i]
+}
+
+// CheckRoot makes sure the workspace root exists and it is writable.
+func (wm *WorkspaceManager) CheckRoot() error {
+	if err := ensureDirectoryExists(wm.root); err != nil {
+		return fmt.Errorf("workspace %v is not usable: %v", wm.root, err)
+	}
+
+	probe, err := ioutil.TempFile(wm.root, ".cider-probe-")
+	if err != nil {
+		return fmt.Errorf("workspace %v is not writable: %v", wm.root, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
 func (wm *WorkspaceManager) GetWorkspaceQueue(ws string) chan bool {
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
@@ -44,11 +341,145 @@ func (wm *WorkspaceManager) GetWorkspaceQueue(ws string) chan bool {
 func (wm *WorkspaceManager) EnsureWorkspaceExists(repoURL *url.URL) (ws string, err error) {
 	// Generate the project workspace path from the global workspace and
 	// the repository URL so that the same repository names do not collide
-	// unless the whole repository URLs are the same.
-	ws = filepath.Join(wm.root, repoURL.Host, repoURL.Path, repoURL.Fragment)
+	// unless the whole repository URLs are the same. The URL is normalized
+	// first so that the equivalent URLs share the workspace. The svn
+	// workspaces are kept apart, the checkouts are not compatible.
+	root := wm.root
+	kind := vcs.Kind(repoURL.Scheme)
+	switch kind {
+	case "git":
+	case "svn":
+		root = filepath.Join(wm.root, svnWorkspaceDir)
+	default:
+		return "", fmt.Errorf("unknown vcs scheme: %v", repoURL.Scheme)
+	}
+	host, path := normalizeRepoURL(repoURL)
+	ws = filepath.Join(root, host, path, repoURL.Fragment)
 
 	// Make sure the project workspace exists.
-	err = ensureDirectoryExists(ws)
+	if err = ensureDirectoryExists(ws); err != nil {
+		return "", fmt.Errorf("failed to create workspace %v: %v", ws, err)
+	}
+
+	// The git workspaces used to be derived from the URL as it was.
+	if kind == "git" {
+		legacy := filepath.Join(wm.root, repoURL.Host, repoURL.Path, repoURL.Fragment)
+		if err := wm.migrateWorkspace(legacy, ws); err != nil {
+			log.Warnf("Failed to migrate workspace %v to %v: %v", legacy, ws, err)
+		}
+	}
+	return ws, nil
+}
+
+// migrateWorkspace moves the sources from the workspace the repository used
+// before the repository URLs were normalized into the current workspace.
+// In case the current workspace contains the sources already, the legacy
+// sources are removed instead, so that no stale clones are left behind.
+// The migration is skipped while the current workspace is in use, it is
+// retried next time then.
+func (wm *WorkspaceManager) migrateWorkspace(legacy, ws string) error {
+	if legacy == ws {
+		return nil
+	}
+	if exists, err := wm.SrcDirExists(legacy); !exists {
+		return err
+	}
+
+	legacyQueue := wm.GetWorkspaceQueue(legacy)
+	legacyQueue <- true
+	defer func() { <-legacyQueue }()
+
+	queue := wm.GetWorkspaceQueue(ws)
+	select {
+	case queue <- true:
+		defer func() { <-queue }()
+	default:
+		return nil
+	}
+
+	// Check again, the sources may have been migrated meanwhile.
+	if exists, err := wm.SrcDirExists(legacy); !exists {
+		return err
+	}
+	// The paths can point to the same directory on case-insensitive
+	// filesystems, where the hosts differing in case only collide.
+	legacyInfo, err := os.Stat(legacy)
+	if err != nil {
+		return err
+	}
+	wsInfo, err := os.Stat(ws)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(legacyInfo, wsInfo) {
+		return nil
+	}
+	checkedOut, err := wm.SrcDirExists(ws)
+	if err != nil {
+		return err
+	}
+
+	if checkedOut {
+		log.Infof("Removing the sources of legacy workspace %v, superseded by %v", legacy, ws)
+	} else {
+		log.Infof("Moving the sources of legacy workspace %v to %v", legacy, ws)
+	}
+	for _, name := range []string{"src", sourceChecksum, cacheRestoreList} {
+		if checkedOut {
+			err = os.RemoveAll(filepath.Join(legacy, name))
+		} else {
+			err = os.Rename(filepath.Join(legacy, name), filepath.Join(ws, name))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	wm.mu.Lock()
+	if t, ok := wm.used[legacy]; ok {
+		delete(wm.used, legacy)
+		if !checkedOut {
+			wm.used[ws] = t
+		}
+	}
+	wm.mu.Unlock()
+
+	if wm.objects == nil {
+		return nil
+	}
+	if !checkedOut {
+		if err := wm.ImportObjects(ws); err != nil {
+			return err
+		}
+	}
+	_, err = wm.objects.Remove(workspaceID(legacy))
+	return err
+}
+
+// defaultPorts contains the default ports of the supported URL schemes.
+var defaultPorts = map[string]string{
+	"git+ssh":   "22",
+	"svn":       "3690",
+	"svn+ssh":   "22",
+	"git+https": "443",
+}
+
+// normalizeRepoURL returns the host and the path of the repository URL
+// normalized so that the equivalent URLs produce the same result.
+// The host is lowercased and the default port is dropped, the trailing
+// slashes and .git are dropped from the path.
+func normalizeRepoURL(repoURL *url.URL) (host, path string) {
+	host = strings.ToLower(repoURL.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil && port == defaultPorts[repoURL.Scheme] {
+		host = h
+	}
+
+	path = strings.TrimRight(repoURL.Path, "/")
+	path = strings.TrimSuffix(path, ".git")
+	path = strings.TrimRight(path, "/")
 	return
 }
 
@@ -56,6 +487,32 @@ func (mw *WorkspaceManager) SrcDir(workspace string) (srcDir string) {
 	return filepath.Join(workspace, "src")
 }
 
+// SourceChecksum returns the checksum of the workspace sources recorded
+// after the last build. It returns an empty string if there is none.
+func (wm *WorkspaceManager) SourceChecksum(workspace string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(workspace, sourceChecksum))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// SetSourceChecksum records the checksum of the workspace sources.
+// An empty checksum removes the record.
+func (wm *WorkspaceManager) SetSourceChecksum(workspace, sum string) error {
+	path := filepath.Join(workspace, sourceChecksum)
+	if sum == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(sum+"\n"), 0640)
+}
+
 func (wm *WorkspaceManager) SrcDirExists(workspace string) (exists bool, err error) {
 	return checkDirectoryExists(wm.SrcDir(workspace))
 }
@@ -0,0 +1,152 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeRepoURL(t *testing.T) {
+	testCases := []struct {
+		url  string
+		host string
+		path string
+	}{
+		{"git+https://github.com/cider/cider", "github.com", "/cider/cider"},
+		{"git+https://GitHub.com/cider/cider", "github.com", "/cider/cider"},
+		{"git+https://github.com:443/cider/cider", "github.com", "/cider/cider"},
+		{"git+https://github.com:8443/cider/cider", "github.com:8443", "/cider/cider"},
+		{"git+https://github.com/cider/cider.git", "github.com", "/cider/cider"},
+		{"git+https://github.com/cider/cider/", "github.com", "/cider/cider"},
+		{"git+https://github.com/cider/cider.git/", "github.com", "/cider/cider"},
+		{"git+https://github.com/cider/cider/.git", "github.com", "/cider/cider"},
+		{"git+https://github.com/Cider/Cider", "github.com", "/Cider/Cider"},
+		{"git+ssh://git@github.com:22/cider/cider.git", "github.com", "/cider/cider"},
+		{"git+ssh://git@github.com:2222/cider/cider.git", "github.com:2222", "/cider/cider"},
+		{"svn://svn.example.com:3690/repo/trunk", "svn.example.com", "/repo/trunk"},
+		{"svn+ssh://svn.example.com:22/repo/trunk/", "svn.example.com", "/repo/trunk"},
+		{"svn://svn.example.com:22/repo", "svn.example.com:22", "/repo"},
+	}
+
+	for _, tc := range testCases {
+		repoURL, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, path := normalizeRepoURL(repoURL)
+		if host != tc.host || path != tc.path {
+			t.Errorf("%v: expected (%q, %q), got (%q, %q)", tc.url, tc.host, tc.path, host, path)
+		}
+	}
+}
+
+func TestEnsureWorkspaceExists(t *testing.T) {
+	root, err := ioutil.TempDir("", "cider-workspace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	wm := newWorkspaceManager(root)
+	workspace := func(rawURL string) string {
+		repoURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := wm.EnsureWorkspaceExists(repoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	var (
+		gitSSH   = workspace("git+ssh://git@example.com/project.git")
+		gitHTTPS = workspace("git+https://example.com/project")
+		svn      = workspace("svn://example.com/project")
+		svnSSH   = workspace("svn+ssh://example.com/project")
+	)
+	if gitSSH != gitHTTPS {
+		t.Errorf("git URLs of the same repository got different workspaces: %v, %v", gitSSH, gitHTTPS)
+	}
+	if svn != svnSSH {
+		t.Errorf("svn URLs of the same repository got different workspaces: %v, %v", svn, svnSSH)
+	}
+	if gitSSH == svn {
+		t.Errorf("git and svn repositories share workspace %v", svn)
+	}
+	if expected := filepath.Join(root, "example.com", "project"); gitSSH != expected {
+		t.Errorf("expected git workspace %v, got %v", expected, gitSSH)
+	}
+}
+
+func TestEnsureWorkspaceExists_MigrateLegacy(t *testing.T) {
+	root, err := ioutil.TempDir("", "cider-workspace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	wm := newWorkspaceManager(root)
+	checkout := func(ws string) {
+		if err := os.MkdirAll(filepath.Join(ws, "src"), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(ws, "src", "origin"), []byte(ws), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workspace := func(rawURL string) string {
+		repoURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := wm.EnsureWorkspaceExists(repoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	// The legacy sources are moved into the normalized workspace.
+	legacy := filepath.Join(root, "Example.com", "project.git")
+	checkout(legacy)
+	ws := workspace("git+ssh://Example.com/project.git")
+	if ws == legacy {
+		t.Fatalf("workspace %v not normalized", ws)
+	}
+	origin, err := ioutil.ReadFile(filepath.Join(ws, "src", "origin"))
+	if err != nil {
+		t.Fatalf("sources not moved to %v: %v", ws, err)
+	}
+	if string(origin) != legacy {
+		t.Errorf("expected the sources from %v, got %s", legacy, origin)
+	}
+	if exists, _ := wm.SrcDirExists(legacy); exists {
+		t.Errorf("legacy sources left in %v", legacy)
+	}
+
+	// The legacy sources are removed when the workspace has the sources.
+	legacy = filepath.Join(root, "example.com", "project.git")
+	checkout(legacy)
+	if workspace("git+https://example.com/project.git") != ws {
+		t.Fatal("equivalent URLs got different workspaces")
+	}
+	origin, err = ioutil.ReadFile(filepath.Join(ws, "src", "origin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(origin) == legacy {
+		t.Errorf("sources in %v replaced by the legacy sources", ws)
+	}
+	if exists, _ := wm.SrcDirExists(legacy); exists {
+		t.Errorf("legacy sources left in %v", legacy)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"math/rand"
+	"sync"
+	"time"
+
+	// Others
+	log "github.com/cihub/seelog"
+)
+
+// DefaultReconnectCoordinator is the coordinator shared by the slaves that
+// do not need a coordinator of their own.
+var DefaultReconnectCoordinator = NewReconnectCoordinator(time.Second)
+
+// Backoff implements exponential backoff. It is not safe for concurrent use.
+type Backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{min: min, max: max}
+}
+
+// Next returns the next delay, doubling the delay every time it is called
+// until it reaches the maximum.
+func (b *Backoff) Next() time.Duration {
+	switch {
+	case b.current == 0:
+		b.current = b.min
+	case 2*b.current > b.max:
+		b.current = b.max
+	default:
+		b.current = 2 * b.current
+	}
+	return b.current
+}
+
+// Reset makes the following call to Next return the minimum delay again.
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+// ReconnectCoordinator rate-limits the reconnect attempts of all the slaves
+// sharing it, so that the slaves running in the same process do not all
+// reconnect at once when the master node comes back.
+//
+// Every reconnect attempt is assigned a slot at least interval apart from
+// the other slots. Random jitter is added to the requested delay so that
+// the slaves that got disconnected at the same time spread out even more.
+type ReconnectCoordinator struct {
+	interval time.Duration
+	next     time.Time
+	rnd      *rand.Rand
+	mu       *sync.Mutex
+}
+
+func NewReconnectCoordinator(interval time.Duration) *ReconnectCoordinator {
+	return &ReconnectCoordinator{
+		interval: interval,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		mu:       new(sync.Mutex),
+	}
+}
+
+// Wait blocks for at least delay and until the next free reconnect slot.
+// It returns false when cancel is closed before that happens.
+func (coordinator *ReconnectCoordinator) Wait(delay time.Duration, cancel <-chan struct{}) bool {
+	at := coordinator.reserve(delay)
+	wait := at.Sub(time.Now())
+	log.Infof("Waiting for %v before reconnecting...", wait)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func (coordinator *ReconnectCoordinator) reserve(delay time.Duration) time.Time {
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+
+	if delay > 0 {
+		delay += time.Duration(coordinator.rnd.Int63n(int64(delay)/2 + 1))
+	}
+	at := time.Now().Add(delay)
+	if at.Before(coordinator.next) {
+		at = coordinator.next
+	}
+	coordinator.next = at.Add(coordinator.interval)
+	return at
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	// Cider
+	"github.com/cider/cider/build"
+	"github.com/cider/cider/data"
+	"github.com/cider/cider/utils"
+
+	// Others
+	log "github.com/cihub/seelog"
+	"github.com/tchap/gocli"
+)
+
+var (
+	runWorkspace  string
+	runRepository string
+	runScript     string
+	runRunner     string
+	runTimeout    time.Duration
+	runSecretsDir string
+	runEnv        = data.Env(make([]string, 0))
+	runSecrets    = data.Env(make([]string, 0))
+)
+
+var RunCommand = &gocli.Command{
+	UsageLine: `
+  run -workspace=WORKSPACE -runner=RUNNER -repository=REPO -script=SCRIPT
+      [-env KEY=VALUE ...] [-env-secret KEY=BACKEND:REF ...]
+      [-secrets=SECRETS] [-timeout=DURATION]`,
+	Short: "run a single build locally",
+	Long: `
+    Run a single build on this machine and exit, without connecting to any
+    build master. The build is processed the same way a build slave processes
+    the build requests, so the repository located at REPO is cloned or pulled
+    into WORKSPACE and SCRIPT is run using RUNNER. This is handy for testing
+    the build scripts and for the CI runners that do not need a build master.
+
+    The build output is printed to the console. The exit code is 0 when
+    the build succeeds, 1 otherwise. The build is interrupted on SIGINT.
+
+  ENVIRONMENT:
+    CIDER_SLAVE_WORKSPACE
+    CIDER_SLAVE_SECRETS
+	`,
+	Action: runLocalBuild,
+}
+
+func init() {
+	cmd := RunCommand
+	cmd.Flags.StringVar(&runWorkspace, "workspace", runWorkspace, "build workspace")
+	cmd.Flags.StringVar(&runRunner, "runner", runRunner, "script runner")
+	cmd.Flags.StringVar(&runRepository, "repository", runRepository, "project repository URL")
+	cmd.Flags.StringVar(&runScript, "script", runScript, "relative path to the script to run")
+	cmd.Flags.Var(&runEnv, "env", "define an environment variable for the build run")
+	cmd.Flags.Var(&runSecrets, "env-secret", "define an environment variable resolved from a secret")
+	cmd.Flags.StringVar(&runSecretsDir, "secrets", runSecretsDir, "directory containing build secrets")
+	cmd.Flags.DurationVar(&runTimeout, "timeout", runTimeout, "build script timeout; 0 means no timeout")
+}
+
+func runLocalBuild(cmd *gocli.Command, argv []string) {
+	// Make sure there were no arguments specified.
+	if len(argv) != 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	// Read the environment to fill in missing parameters.
+	utils.GetenvOrFailNow(&runWorkspace, "CIDER_SLAVE_WORKSPACE", cmd)
+	utils.Getenv(&runSecretsDir, "CIDER_SLAVE_SECRETS")
+
+	// The slave logging is not needed, all the output goes to the console.
+	log.ReplaceLogger(log.Disabled)
+
+	// Parse the build arguments the same way the build client does.
+	_, args, err := data.ParseArgs(LocalSender, runRepository, runScript, runRunner, runEnv)
+	if err != nil {
+		fail(err)
+	}
+	args.Secrets = runSecrets
+	args.Timeout = runTimeout
+	if err := args.Validate(); err != nil {
+		fail(err)
+	}
+
+	// Interrupt the build on signal.
+	interruptedCh := make(chan struct{})
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		fmt.Println("---> Interrupting the build, this can take a few seconds")
+		close(interruptedCh)
+	}()
+
+	slave := New(LocalSender, runWorkspace, 1)
+	slave.SecretsDir = runSecretsDir
+	stdout, flush := build.FilterProgress(os.Stdout, os.Stderr)
+	_, result, err := slave.Run(runRunner, args, stdout, os.Stderr, interruptedCh)
+	flush()
+	if err != nil {
+		fail(err)
+	}
+	if result != nil && result.Error != "" {
+		fail(result.Error)
+	}
+}
+
+func fail(v interface{}) {
+	fmt.Fprintf(os.Stderr, "\nError: %v\n", v)
+	os.Exit(1)
+}
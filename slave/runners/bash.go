@@ -13,7 +13,8 @@ func bashFactory() *Runner {
 	}
 
 	return &Runner{
-		Name: "bash",
+		Name:        "bash",
+		Description: "runs the script using bash",
 		NewCommand: func(script string) *exec.Cmd {
 			return exec.Command("bash", script)
 		},
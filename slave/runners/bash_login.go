@@ -0,0 +1,23 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package runners
+
+import "os/exec"
+
+func bashLoginFactory() *Runner {
+	if exec.Command("bash", "--version").Run() != nil {
+		return nil
+	}
+
+	return &Runner{
+		Name:        "bash-login",
+		Description: "runs the script using bash as a login shell",
+		LoginShell:  true,
+		NewCommand: func(script string) *exec.Cmd {
+			return exec.Command("bash", "--login", script)
+		},
+	}
+}
@@ -16,7 +16,8 @@ func cmdFactory() *Runner {
 	}
 
 	return &Runner{
-		Name: "cmd",
+		Name:        "cmd",
+		Description: "runs the script using cmd.exe",
 		NewCommand: func(script string) *exec.Cmd {
 			return exec.Command("cmd.exe", "/c", filepath.FromSlash(script))
 		},
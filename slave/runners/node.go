@@ -13,7 +13,8 @@ func nodeFactory() *Runner {
 	}
 
 	return &Runner{
-		Name: "node",
+		Name:        "node",
+		Description: "evaluates the script using node",
 		NewCommand: func(script string) *exec.Cmd {
 			return exec.Command("node", "-e", script)
 		},
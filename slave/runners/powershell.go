@@ -5,17 +5,31 @@
 
 package runners
 
-import "os/exec"
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	log "github.com/cihub/seelog"
+)
 
 func powerShellFactory() *Runner {
-	if exec.Command("PowerShell.exe", "-Command", "& {Get-Date}").Run() != nil {
+	path, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		// PowerShell is expected to be available on Windows, so its absence
+		// is worth a warning there. It is rarely installed elsewhere.
+		if runtime.GOOS == "windows" {
+			log.Warnf("Runner powershell disabled: powershell.exe not found in PATH: %v", err)
+		}
 		return nil
 	}
 
 	return &Runner{
-		Name: "powershell",
+		Name:        "powershell",
+		Description: "runs the script using PowerShell.exe",
 		NewCommand: func(script string) *exec.Cmd {
-			return exec.Command("PowerShell.exe", "-NoLogo", "-NonInteractive", script)
+			return exec.Command(path, "-NoLogo", "-NonInteractive",
+				"-ExecutionPolicy", "Bypass", "-File", filepath.FromSlash(script))
 		},
 	}
 }
@@ -5,22 +5,58 @@
 
 package runners
 
-import "os/exec"
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ScriptPlaceholder is used in place of the script path in the command
+// templates returned by List.
+const ScriptPlaceholder = "SCRIPT"
 
 type Runner struct {
-	Name       string
+	Name        string
+	Description string
+
+	// LoginShell is set for the runners that source the profile of the user
+	// running the slave before running the script. The profile can change
+	// the environment exported for the build, so these runners are not
+	// exported unless the slave explicitly enables them.
+	LoginShell bool
+
 	NewCommand func(script string) *exec.Cmd
 }
 
 var factories = [...]func() *Runner{
 	bashFactory,
+	bashLoginFactory,
 	cmdFactory,
 	powerShellFactory,
 	nodeFactory,
 }
 
+// reservedNames cannot be used as runner names, the slaves export methods
+// with these names for every label.
+var reservedNames = map[string]bool{
+	"runners":      true,
+	"capabilities": true,
+}
+
+// nameRegexp matches the valid runner names. The name is a part of
+// the method name, so it cannot contain dots.
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Available contains the registered runners, the built-in runners that are
+// available on this machine first. It is filled using Register and
+// RegisterRunner, it is not supposed to be modified directly.
 var Available = make([]*Runner, 0)
 
+// mu serializes the registrations.
+var mu = new(sync.Mutex)
+
 func init() {
 	ch := make(chan *Runner, len(factories))
 	for i := range factories {
@@ -30,7 +66,79 @@ func init() {
 	}
 	for _ = range factories {
 		if runner := <-ch; runner != nil {
-			Available = append(Available, runner)
+			if err := RegisterRunner(runner); err != nil {
+				panic(err)
+			}
 		}
 	}
 }
+
+// Register makes a custom runner available, so that the build slaves export
+// it. factory returns the command that runs the given script. The runners
+// must be registered before the slave connects, the slave exports
+// the runners that are registered at that moment.
+func Register(name string, factory func(script string) *exec.Cmd) error {
+	return RegisterRunner(&Runner{
+		Name:        name,
+		Description: "custom runner",
+		NewCommand:  factory,
+	})
+}
+
+// RegisterRunner is like Register, but it takes the whole runner definition.
+// It returns an error in case the name is not valid or it is already taken.
+func RegisterRunner(runner *Runner) error {
+	switch {
+	case !nameRegexp.MatchString(runner.Name):
+		return fmt.Errorf("invalid runner name: %q", runner.Name)
+	case reservedNames[runner.Name]:
+		return fmt.Errorf("runner name is reserved: %v", runner.Name)
+	case runner.NewCommand == nil:
+		return fmt.Errorf("runner %v has no command factory", runner.Name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range Available {
+		if r.Name == runner.Name {
+			return fmt.Errorf("runner already registered: %v", runner.Name)
+		}
+	}
+	Available = append(Available, runner)
+	return nil
+}
+
+// RunnerInfo describes a runner.
+type RunnerInfo struct {
+	Name        string   `codec:"name"`
+	Description string   `codec:"description"`
+	Command     []string `codec:"command"`
+	LoginShell  bool     `codec:"loginShell,omitempty"`
+}
+
+// Describe returns the runner description. The command template is generated
+// by the runner itself, so it is always up to date.
+func (runner *Runner) Describe() *RunnerInfo {
+	return &RunnerInfo{
+		Name:        runner.Name,
+		Description: runner.Description,
+		Command:     runner.NewCommand(ScriptPlaceholder).Args,
+		LoginShell:  runner.LoginShell,
+	}
+}
+
+// List describes all the available runners, sorted by name.
+func List() []*RunnerInfo {
+	infos := make([]*RunnerInfo, 0, len(Available))
+	for _, runner := range Available {
+		infos = append(infos, runner.Describe())
+	}
+	sort.Sort(byName(infos))
+	return infos
+}
+
+type byName []*RunnerInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,61 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	// Stdlib
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	// Cider
+	"github.com/cider/cider/slave/runners"
+
+	// Others
+	"github.com/tchap/gocli"
+)
+
+var RunnersCommand = &gocli.Command{
+	UsageLine: "runners",
+	Short:     "list the runners available on this machine",
+	Long: `
+    List the runners that a build slave started on this machine would export,
+    together with the command used to run the build scripts. SCRIPT stands for
+    the path of the build script.
+
+    The login shell runners are only exported when the build slave is started
+    with -login-shells.
+
+    The build slaves export the same list as method cider.LABEL.runners.
+	`,
+	Action: listRunners,
+}
+
+func listRunners(cmd *gocli.Command, args []string) {
+	// Make sure there were no arguments specified.
+	if len(args) != 0 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	infos := runners.List()
+	if len(infos) == 0 {
+		fmt.Println("No runners available")
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCOMMAND\tDESCRIPTION")
+	for _, info := range infos {
+		desc := info.Description
+		if info.LoginShell {
+			desc += " (requires -login-shells)"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", info.Name, strings.Join(info.Command, " "), desc)
+	}
+	tw.Flush()
+}
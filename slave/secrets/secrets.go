@@ -0,0 +1,184 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package secrets resolves secret references sent by the build clients.
+//
+// A secret reference looks like BACKEND:REF, e.g. file:db/password. The build
+// clients only send the references, the values are looked up on the build
+// slave, so the secrets never leave the machine they are stored on.
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix is prepended to the reference by the env backend, so that only
+// the variables meant to be secrets can be read by the builds.
+const EnvPrefix = "CIDER_SECRET_"
+
+// Resolver looks up the secret value associated with the given reference.
+type Resolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// Store dispatches secret references to the registered backends.
+type Store struct {
+	backends map[string]Resolver
+}
+
+// NewStore returns a store with the env backend registered. The file backend
+// is registered as well in case dir is not empty.
+func NewStore(dir string) *Store {
+	store := &Store{make(map[string]Resolver)}
+	store.Register("env", envResolver{})
+	if dir != "" {
+		store.Register("file", fileResolver{dir})
+	}
+	return store
+}
+
+// Register makes the resolver available under the given backend name.
+// Any existing resolver registered under the same name is replaced.
+func (store *Store) Register(backend string, resolver Resolver) {
+	store.backends[backend] = resolver
+}
+
+// Resolve resolves a reference of the form BACKEND:REF.
+func (store *Store) Resolve(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid secret reference: %v", ref)
+	}
+
+	resolver, ok := store.backends[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown secret backend: %v", parts[0])
+	}
+	return resolver.Resolve(parts[1])
+}
+
+// envResolver reads the secrets from the environment of the build slave.
+type envResolver struct{}
+
+func (envResolver) Resolve(ref string) (string, error) {
+	v := os.Getenv(EnvPrefix + ref)
+	if v == "" {
+		return "", fmt.Errorf("secret not set: %v%v", EnvPrefix, ref)
+	}
+	return v, nil
+}
+
+// fileResolver reads the secrets from the files located in dir.
+type fileResolver struct {
+	dir string
+}
+
+func (resolver fileResolver) Resolve(ref string) (string, error) {
+	// Make sure the reference does not point outside of the secrets directory.
+	path := filepath.Join(resolver.dir, filepath.FromSlash(ref))
+	rel, err := filepath.Rel(resolver.dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid secret reference: %v", ref)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// placeholder replaces the secret values in the output.
+var placeholder = []byte("********")
+
+// Redactor replaces the secret values with a placeholder before passing
+// the data on to the underlying writer.
+//
+// A secret can be split between two writes, so the end of the data that can
+// be the beginning of a secret is held back until the next write. That is
+// less than the longest secret. Flush must be called once all the data is
+// written to pass the rest on.
+type Redactor struct {
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func NewRedactor(w io.Writer, secrets []string) *Redactor {
+	bs := make([][]byte, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			bs = append(bs, []byte(secret))
+		}
+	}
+	// The longest secret wins when the secrets start at the same position.
+	sort.Sort(byLength(bs))
+	return &Redactor{w: w, secrets: bs}
+}
+
+func (redactor *Redactor) Write(p []byte) (n int, err error) {
+	data := append(redactor.pending, p...)
+	out, rest := redactor.redact(data, false)
+	redactor.pending = append([]byte(nil), rest...)
+	if len(out) != 0 {
+		if _, err := redactor.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush passes on the data held back, redacted.
+func (redactor *Redactor) Flush() error {
+	out, _ := redactor.redact(redactor.pending, true)
+	redactor.pending = nil
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := redactor.w.Write(out)
+	return err
+}
+
+// redact replaces the secrets in data. Unless final is set, the end of data
+// that is the beginning of a secret is not processed and it is returned
+// as rest. That applies even when the end of data is a whole secret already,
+// but also the beginning of a longer secret, which could be completed by
+// the next write.
+func (redactor *Redactor) redact(data []byte, final bool) (out, rest []byte) {
+	out = make([]byte, 0, len(data))
+Scan:
+	for i := 0; i < len(data); {
+		if !final {
+			for _, secret := range redactor.secrets {
+				if len(data)-i < len(secret) && bytes.HasPrefix(secret, data[i:]) {
+					return out, data[i:]
+				}
+			}
+		}
+		for _, secret := range redactor.secrets {
+			if bytes.HasPrefix(data[i:], secret) {
+				out = append(out, placeholder...)
+				i += len(secret)
+				continue Scan
+			}
+		}
+		out = append(out, data[i])
+		i++
+	}
+	return out, nil
+}
+
+type byLength [][]byte
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
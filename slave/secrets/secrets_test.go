@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package secrets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	testCases := []struct {
+		secrets []string
+		writes  []string
+		output  string
+	}{
+		{[]string{"secret"}, []string{"a secret b"}, "a ******** b"},
+		{[]string{"secret"}, []string{"a sec", "ret b"}, "a ******** b"},
+		{[]string{"secret"}, []string{"a sec"}, "a sec"},
+		{[]string{"abc", "abcdef"}, []string{"x abc", "def y"}, "x ******** y"},
+		{[]string{"abc", "abcdef"}, []string{"x abc", "de y"}, "x ********de y"},
+		{[]string{"abc", "abcdef"}, []string{"x abc"}, "x ********"},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		redactor := NewRedactor(&buf, tc.secrets)
+		for _, w := range tc.writes {
+			if _, err := redactor.Write([]byte(w)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := redactor.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if output := buf.String(); output != tc.output {
+			t.Errorf("%q written as %q: expected %q, got %q", tc.secrets, tc.writes, tc.output, output)
+		}
+	}
+}
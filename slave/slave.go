@@ -7,14 +7,20 @@ package slave
 
 import (
 	// Stdlib
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	// Cider
+	"github.com/cider/cider/data"
 	"github.com/cider/cider/slave/runners"
+	"github.com/cider/cider/slave/secrets"
+	"github.com/cider/cider/utils/executil"
 
 	// Meeko
 	"github.com/meeko/go-meeko/meeko/services/rpc"
@@ -27,37 +33,195 @@ import (
 
 const TokenHeader = "X-Meeko-Token"
 
+// RunnersMethod is exported for every label as cider.LABEL.runners. It returns
+// RunnersResult describing the runners exported by the slave, so it cannot be
+// used as a runner name.
+const RunnersMethod = "runners"
+
+// CapabilitiesMethod is exported for every label as cider.LABEL.capabilities.
+// It returns data.Capabilities, so it cannot be used as a runner name.
+const CapabilitiesMethod = "capabilities"
+
 const (
 	errorCalmPeriod = 10 * time.Second
 	errorThreshold  = 5
 
 	minBackoff = time.Second
 	maxBackoff = time.Minute
+
+	defaultRegisterAttempts = 5
+	defaultProgressInterval = 10 * time.Second
 )
 
+// identityRegexp matches the identities that are safe to be used as
+// a directory name on all platforms.
+var identityRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
 var (
 	ErrConnected    = errors.New("build slave already connected")
 	ErrDisconnected = errors.New("build slave has not been connected")
 )
 
 type BuildSlave struct {
+	// InheritEnv lists the environment variables of the slave process that
+	// are passed on to the build scripts in addition to the default ones,
+	// see DefaultInheritedEnv. A trailing * matches any suffix, e.g. JAVA_*.
+	// The rest of the slave environment is not passed on since it may
+	// contain secrets, e.g. the master access token.
+	InheritEnv []string
+
+	// InheritAllEnv can be set to pass the whole environment of the slave
+	// process on to the build scripts, overriding InheritEnv.
+	InheritAllEnv bool
+
+	// BaseEnv is the list of KEY=VALUE pairs exported for every build,
+	// e.g. proxy settings. The variables requested by the build override
+	// the base environment, which overrides the slave process environment.
+	BaseEnv []string
+
+	// BaseSecrets is the list of KEY=BACKEND:REF pairs resolved into
+	// secrets and exported for every build, the same way as BaseEnv.
+	// The secret values are masked in the build output.
+	BaseSecrets []string
+
+	// MaxBuildTime limits how long a build script can run. The builds
+	// requesting no timeout get this one, the builds requesting a longer one
+	// have the timeout cut down to this one. Zero means that there is no limit.
+	MaxBuildTime time.Duration
+
+	// RunnerTimeouts maps runner names to the default timeouts applied to
+	// the builds that do not request any timeout. These are still limited by
+	// MaxBuildTime.
+	RunnerTimeouts map[string]time.Duration
+
+	// MaxConcurrentPulls limits the number of VCS operations (clone, pull)
+	// running in parallel, independently of the number of executors.
+	// Zero means that there is no limit.
+	MaxConcurrentPulls uint
+
+	// SecretsDir is the directory the file secret backend reads from.
+	// The file backend is disabled when this is empty.
+	SecretsDir string
+
+	// OutputCharset is the charset the build scripts emit their output in.
+	// The output is transcoded into UTF-8 unless this is empty.
+	// See charset.Supported for the list of supported charsets.
+	OutputCharset string
+
+	// SharedObjects makes the git workspaces share objects through a common
+	// object store located in the workspace root. This saves disk space and
+	// speeds up cloning of related repositories.
+	SharedObjects bool
+
+	// NamespaceWorkspace makes the slave use a subdirectory of the workspace
+	// named after the slave identity, so that multiple slaves can share
+	// the same workspace, e.g. on a network filesystem. The workspaces,
+	// the shared object store and the build caches are not shared between
+	// the slaves then.
+	NamespaceWorkspace bool
+
+	// VerifySources makes the slave record a checksum of the sources after
+	// every build and verify it before the next build of the same workspace.
+	// The sources are cloned again when they do not match.
+	VerifySources bool
+
+	// CleanCheckout makes the slave remove the sources before every build,
+	// so that the repository is always cloned from scratch instead of being
+	// pulled. The builds can request this using BuildArgs.Clean as well.
+	CleanCheckout bool
+
+	// LoginShells enables the runners that run the scripts through a login
+	// shell, e.g. bash-login. See runners.Runner.LoginShell.
+	LoginShells bool
+
+	// CacheLimit is the maximum total size of the build caches in bytes.
+	// The build caches are disabled when this is zero.
+	// See package cache for how the build scripts use the caches.
+	CacheLimit int64
+
+	// WorkspaceLimit is the maximum number of workspaces with the sources
+	// checked out. The sources of the least recently used workspaces are
+	// removed once the limit is exceeded, except for the workspaces being
+	// used by a build. Zero means that there is no limit.
+	WorkspaceLimit uint
+
+	// BuildLogDir is the directory the output of every build is written to,
+	// one file per build, in addition to being streamed to the client.
+	// The build logs are disabled when this is empty.
+	BuildLogDir string
+
+	// BuildLogMaxFiles and BuildLogMaxAge limit the build logs kept in
+	// BuildLogDir. The oldest logs are removed first. Zero means no limit.
+	BuildLogMaxFiles int
+	BuildLogMaxAge   time.Duration
+
+	// IdempotencyWindow is how long the result of a build requested with
+	// an idempotency key is kept after the build finishes. The requests
+	// repeating the key within the window get the same result instead of
+	// starting a new build. The requests repeating the key while the build is
+	// still running are attached to it. The results are not kept across
+	// reconnects. It is set to 10 minutes by New.
+	IdempotencyWindow time.Duration
+
+	// RegisterAttempts is the number of times registering a method is tried
+	// before the slave gives up. The attempts are separated using exponential
+	// backoff. Permanent errors, e.g. a method being registered twice, are
+	// never retried. It is set to 5 by New.
+	RegisterAttempts uint
+
+	// ProgressInterval is how often the slave signals progress to the client
+	// while pulling the sources and while running the build script, so that
+	// the client knows the build is alive even when there is no output.
+	// Zero disables the signals. It is set to 10 seconds by New.
+	ProgressInterval time.Duration
+
+	// StopPolicy defines how the build scripts are stopped when the build is
+	// interrupted or it times out. It is set to executil.DefaultPolicy by New.
+	StopPolicy executil.Policy
+
+	// TLSConfig is used when connecting to a wss:// master, e.g. to trust
+	// a private certificate authority. See utils.LoadTLSConfig.
+	// The defaults are used when this is nil.
+	TLSConfig *tls.Config
+
 	identity     string
 	workspace    string
 	numExecutors uint
+	counter      *buildCounter
+	builds       *buildRegistry
 	service      *rpc.Service
 	mu           *sync.Mutex
 }
 
 func New(identity, workspace string, numExecutors uint) *BuildSlave {
 	return &BuildSlave{
-		identity:     identity,
-		workspace:    workspace,
-		numExecutors: numExecutors,
-		mu:           new(sync.Mutex),
+		IdempotencyWindow: defaultIdempotencyWindow,
+		RegisterAttempts:  defaultRegisterAttempts,
+		ProgressInterval:  defaultProgressInterval,
+		StopPolicy:        executil.DefaultPolicy,
+		identity:          identity,
+		workspace:         workspace,
+		numExecutors:      numExecutors,
+		counter:           newBuildCounter(),
+		mu:                new(sync.Mutex),
 	}
 }
 
 func (slave *BuildSlave) Connect(master, token string) (err error) {
+	// Make sure the workspace and the rest of the configuration is usable
+	// before connecting to the master node, otherwise the builds would be
+	// failing one by one.
+	shared, err := slave.prepare()
+	if err != nil {
+		return err
+	}
+
+	// Make sure there is something to be exported at all.
+	rs := slave.runners()
+	if len(rs) == 0 {
+		return slave.noRunnersError()
+	}
+
 	// Connect to the master node using the WebSocket transport.
 	// The specified token is used to authenticated the build slave.
 	slave.mu.Lock()
@@ -71,6 +235,9 @@ func (slave *BuildSlave) Connect(master, token string) (err error) {
 		factory.Origin = "http://localhost"
 		factory.WSConfigFunc = func(config *websocket.Config) {
 			config.Header.Set(TokenHeader, token)
+			if slave.TLSConfig != nil {
+				config.TlsConfig = slave.TLSConfig
+			}
 		}
 		return factory.NewTransport(slave.identity)
 	})
@@ -81,35 +248,41 @@ func (slave *BuildSlave) Connect(master, token string) (err error) {
 	slave.service = service
 	slave.mu.Unlock()
 
-	// Number of concurrent builds is limited by creating a channel of the
-	// specified length. Every time a build is requested, the request handler
-	// sends some data to the channel, and when it is finished, it reads data
-	// from the same channel.
-	execQueue := make(chan bool, slave.numExecutors)
-	log.Infof("Initiating %v build executor(s)", slave.numExecutors)
-
 	// Export all available labels and runners.
 	log.Info("Available runners:")
-	for _, runner := range runners.Available {
-		log.Infof("---> %v", runner.Name)
+	for _, runner := range rs {
+		if timeout, ok := slave.RunnerTimeouts[runner.Name]; ok {
+			log.Infof("---> %v (default timeout %v)", runner.Name, timeout)
+		} else {
+			log.Infof("---> %v", runner.Name)
+		}
 	}
 
-	manager := newWorkspaceManager(slave.workspace)
-
-	ls := []string{"any"}
-	if labels != "" {
-		ls = append(ls, strings.Split(labels, ",")...)
-	}
+	ls := slaveLabels()
 
-	for _, label := range ls {
-		for _, runner := range runners.Available {
+	// The methods are exported for the slave identity as well, so that
+	// a particular slave can be requested.
+	for _, label := range methodLabels(slave.identity, ls) {
+		for _, runner := range rs {
 			methodName := fmt.Sprintf("cider.%v.%v", label, runner.Name)
-			builder := &Builder{runner, manager, execQueue}
-			if ex := service.RegisterMethod(methodName, builder.Build); ex != nil {
+			builder := slave.newBuilder(runner, shared)
+			if ex := slave.registerMethod(service, methodName, builder.Build); ex != nil {
 				err = ex
 				goto Close
 			}
 		}
+
+		methodName := fmt.Sprintf("cider.%v.%v", label, RunnersMethod)
+		if ex := slave.registerMethod(service, methodName, slave.describeRunners(rs)); ex != nil {
+			err = ex
+			goto Close
+		}
+
+		methodName = fmt.Sprintf("cider.%v.%v", label, CapabilitiesMethod)
+		if ex := slave.registerMethod(service, methodName, slave.describeCapabilities(shared.root, ls, rs)); ex != nil {
+			err = ex
+			goto Close
+		}
 	}
 
 	log.Info("Waiting for build requests...")
@@ -132,6 +305,263 @@ Wait:
 	return
 }
 
+// builderShared is the state shared by all the builders of the slave.
+type builderShared struct {
+	root      string
+	manager   *WorkspaceManager
+	execQueue chan bool
+	vcsQueue  chan bool
+	secrets   *secrets.Store
+	builds    *buildRegistry
+	buildLogs *buildLogDir
+}
+
+// prepare checks the slave configuration and sets up the state shared by
+// the builders.
+func (slave *BuildSlave) prepare() (*builderShared, error) {
+	root := slave.workspace
+	if slave.NamespaceWorkspace {
+		if !identityRegexp.MatchString(slave.identity) || slave.identity == "." || slave.identity == ".." {
+			return nil, fmt.Errorf("slave identity cannot be used as a directory name: %q", slave.identity)
+		}
+		root = filepath.Join(root, slave.identity)
+	}
+	manager := newWorkspaceManager(root)
+	if err := manager.CheckRoot(); err != nil {
+		return nil, err
+	}
+
+	// Make sure the base environment is valid, the builds would fail otherwise.
+	for _, kv := range slave.BaseEnv {
+		if !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("invalid base environment variable: %v", kv)
+		}
+	}
+	for _, kv := range slave.BaseSecrets {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.Contains(parts[1], ":") {
+			return nil, fmt.Errorf("invalid base secret: %v", kv)
+		}
+	}
+
+	shared := &builderShared{
+		root:    root,
+		manager: manager,
+		secrets: secrets.NewStore(slave.SecretsDir),
+	}
+
+	// The registry is kept when taken over from the previous slave instance.
+	if slave.builds == nil {
+		slave.builds = newBuildRegistry(slave.IdempotencyWindow)
+	}
+	shared.builds = slave.builds
+
+	// Number of concurrent builds is limited by creating a channel of the
+	// specified length. Every time a build is requested, the request handler
+	// sends some data to the channel, and when it is finished, it reads data
+	// from the same channel.
+	shared.execQueue = make(chan bool, slave.numExecutors)
+	log.Infof("Initiating %v build executor(s)", slave.numExecutors)
+
+	// VCS operations are limited the same way, but only if requested.
+	if slave.MaxConcurrentPulls != 0 {
+		shared.vcsQueue = make(chan bool, slave.MaxConcurrentPulls)
+		log.Infof("Limiting concurrent VCS operations to %v", slave.MaxConcurrentPulls)
+	}
+
+	if slave.SharedObjects {
+		log.Info("Enabling the shared git object store")
+		if err := manager.EnableObjectStore(); err != nil {
+			return nil, err
+		}
+	}
+
+	if slave.CacheLimit != 0 {
+		log.Infof("Enabling the build cache, limited to %v bytes", slave.CacheLimit)
+		if err := manager.EnableCache(slave.CacheLimit); err != nil {
+			return nil, err
+		}
+	}
+
+	if slave.WorkspaceLimit != 0 {
+		log.Infof("Limiting the number of workspaces to %v", slave.WorkspaceLimit)
+		if err := manager.EnableWorkspaceLimit(int(slave.WorkspaceLimit)); err != nil {
+			return nil, err
+		}
+	}
+
+	if slave.BuildLogDir != "" {
+		log.Infof("Writing build logs into %v", slave.BuildLogDir)
+		logs, err := openBuildLogDir(slave.BuildLogDir, slave.BuildLogMaxFiles, slave.BuildLogMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		shared.buildLogs = logs
+	}
+
+	return shared, nil
+}
+
+func (slave *BuildSlave) newBuilder(runner *runners.Runner, shared *builderShared) *Builder {
+	return &Builder{
+		identity:       slave.identity,
+		runner:         runner,
+		manager:        shared.manager,
+		execQueue:      shared.execQueue,
+		vcsQueue:       shared.vcsQueue,
+		secrets:        shared.secrets,
+		outputCharset:  slave.OutputCharset,
+		inheritAllEnv:  slave.InheritAllEnv,
+		inheritEnv:     slave.InheritEnv,
+		verifySources:  slave.VerifySources,
+		cleanCheckout:  slave.CleanCheckout,
+		progressEvery:  slave.ProgressInterval,
+		defaultTimeout: slave.RunnerTimeouts[runner.Name],
+		maxBuildTime:   slave.MaxBuildTime,
+		stopPolicy:     slave.StopPolicy,
+		builds:         shared.builds,
+		buildLogs:      shared.buildLogs,
+		counter:        slave.counter,
+		baseEnv:        slave.BaseEnv,
+		baseSecrets:    slave.BaseSecrets,
+	}
+}
+
+// RunnersResult is returned by the cider.LABEL.runners methods.
+type RunnersResult struct {
+	Slave   string                `codec:"slave"`
+	Runners []*runners.RunnerInfo `codec:"runners"`
+}
+
+func (slave *BuildSlave) describeRunners(rs []*runners.Runner) rpc.RequestHandler {
+	result := &RunnersResult{
+		Slave:   slave.identity,
+		Runners: make([]*runners.RunnerInfo, 0, len(rs)),
+	}
+	for _, runner := range rs {
+		result.Runners = append(result.Runners, runner.Describe())
+	}
+	return func(request rpc.RemoteRequest) {
+		request.Resolve(0, result)
+	}
+}
+
+func (slave *BuildSlave) describeCapabilities(root string, ls []string, rs []*runners.Runner) rpc.RequestHandler {
+	result := &data.Capabilities{
+		Slave:     slave.identity,
+		Labels:    ls,
+		Runners:   make([]string, 0, len(rs)),
+		Workspace: root,
+		Executors: slave.numExecutors,
+	}
+	for _, runner := range rs {
+		result.Runners = append(result.Runners, runner.Name)
+	}
+	return func(request rpc.RemoteRequest) {
+		request.Resolve(0, result)
+	}
+}
+
+// methodLabels returns the labels the methods are exported for, which are
+// the slave labels and the slave identity. The identity is only included
+// once in case it is also used as a label.
+func methodLabels(identity string, ls []string) []string {
+	for _, label := range ls {
+		if label == identity {
+			return ls
+		}
+	}
+	labels := append([]string(nil), ls...)
+	return append(labels, identity)
+}
+
+// runners returns the available runners that are enabled for the slave.
+func (slave *BuildSlave) runners() []*runners.Runner {
+	rs := make([]*runners.Runner, 0, len(runners.Available))
+	for _, runner := range runners.Available {
+		if runner.LoginShell && !slave.LoginShells {
+			continue
+		}
+		rs = append(rs, runner)
+	}
+	return rs
+}
+
+func (slave *BuildSlave) noRunnersError() error {
+	var names []string
+	for _, runner := range runners.Available {
+		name := runner.Name
+		if runner.LoginShell {
+			name += " (disabled, login shell)"
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+	return fmt.Errorf("no methods to export for labels %v; runners found: %v",
+		strings.Join(slaveLabels(), ", "), strings.Join(names, ", "))
+}
+
+// slaveLabels returns the labels the methods are exported for.
+func slaveLabels() []string {
+	ls := []string{"any"}
+	if labels != "" {
+		ls = append(ls, strings.Split(labels, ",")...)
+	}
+	return ls
+}
+
+func (slave *BuildSlave) registerMethod(service *rpc.Service, method string, handler rpc.RequestHandler) error {
+	backoff := NewBackoff(minBackoff, maxBackoff)
+	for i := uint(1); ; i++ {
+		err := service.RegisterMethod(method, handler)
+		switch {
+		case err == nil:
+			return nil
+		// These errors are permanent, there is no point in retrying.
+		case err == rpc.ErrAlreadyRegistered:
+			return fmt.Errorf("failed to register %v: %v", method, err)
+		case err == rpc.ErrTerminated:
+			return err
+		case i >= slave.RegisterAttempts:
+			return fmt.Errorf("failed to register %v after %v attempt(s): %v", method, i, err)
+		}
+
+		log.Warnf("Failed to register %v (attempt %v of %v): %v",
+			method, i, slave.RegisterAttempts, err)
+		delay := backoff.Next()
+		log.Infof("Waiting for %v before trying again...", delay)
+		select {
+		case <-time.After(delay):
+		case <-service.Closed():
+			return rpc.ErrTerminated
+		}
+	}
+}
+
+// TakeOver makes the slave continue where the previous instance left off,
+// which is supposed to be used when a new instance is created to reconnect.
+// The builds still running are counted by Stats, and the idempotency keys
+// of the builds requested so far are still recognized. It must be called
+// before Connect.
+func (slave *BuildSlave) TakeOver(previous *BuildSlave) {
+	slave.counter = previous.counter
+	slave.builds = previous.builds
+}
+
+// Stats returns the number of executors and the number of builds running and
+// waiting for an executor. It can be called at any time. The builds are only
+// counted across reconnects when the slave is reconnected using TakeOver.
+func (slave *BuildSlave) Stats() BuildStats {
+	active, queued := slave.counter.snapshot()
+	return BuildStats{
+		Executors:    slave.numExecutors,
+		ActiveBuilds: active,
+		QueuedBuilds: queued,
+	}
+}
+
 func (slave *BuildSlave) Terminate() error {
 	slave.mu.Lock()
 	defer slave.mu.Unlock()
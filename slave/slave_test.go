@@ -0,0 +1,41 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBuildSlave_TakeOver(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "cider-slave-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workspace)
+
+	previous := New("test", workspace, 1)
+	previousShared, err := previous.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.counter.enqueue()
+
+	slave := New("test", workspace, 1)
+	slave.TakeOver(previous)
+	shared, err := slave.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shared.builds != previousShared.builds {
+		t.Error("idempotency registry not taken over")
+	}
+	if stats := slave.Stats(); stats.QueuedBuilds != 1 {
+		t.Errorf("expected 1 queued build, got %v", stats.QueuedBuilds)
+	}
+}
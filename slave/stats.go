@@ -0,0 +1,65 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package slave
+
+import "sync"
+
+// BuildStats describes how busy the build slave is.
+type BuildStats struct {
+	// Executors is the number of builds that can run in parallel.
+	Executors uint
+
+	// ActiveBuilds is the number of builds holding an executor.
+	ActiveBuilds uint
+
+	// QueuedBuilds is the number of builds waiting for the workspace lock
+	// or for a free executor.
+	QueuedBuilds uint
+}
+
+// buildCounter counts the builds being processed by the slave.
+// The counts are always changed together so that a snapshot is consistent.
+type buildCounter struct {
+	active uint
+	queued uint
+	mu     *sync.Mutex
+}
+
+func newBuildCounter() *buildCounter {
+	return &buildCounter{mu: new(sync.Mutex)}
+}
+
+// enqueue records a new build waiting for an executor.
+func (counter *buildCounter) enqueue() {
+	counter.mu.Lock()
+	counter.queued++
+	counter.mu.Unlock()
+}
+
+// start moves a build from the queue to the executors.
+func (counter *buildCounter) start() {
+	counter.mu.Lock()
+	counter.queued--
+	counter.active++
+	counter.mu.Unlock()
+}
+
+// finish removes a build, started tells whether it has got an executor.
+func (counter *buildCounter) finish(started bool) {
+	counter.mu.Lock()
+	if started {
+		counter.active--
+	} else {
+		counter.queued--
+	}
+	counter.mu.Unlock()
+}
+
+func (counter *buildCounter) snapshot() (active, queued uint) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	return counter.active, counter.queued
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package archive packs and unpacks gzipped tarballs of directory trees.
+// Only directories and regular files are supported, symbolic links are
+// skipped since they could point outside of the tree once unpacked.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ValidatePath makes sure path is a relative path that does not point
+// outside of the directory it is relative to.
+func ValidatePath(path string) error {
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if path == "" || filepath.IsAbs(clean) || clean == "." ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid path: %v", path)
+	}
+	return nil
+}
+
+// Pack writes the given paths into w as a gzipped tarball. The paths are
+// relative to root and so are the entry names. Directories are packed
+// recursively.
+func Pack(w io.Writer, root string, paths []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, path := range paths {
+		if err := ValidatePath(path); err != nil {
+			return err
+		}
+		if err := packTree(tw, root, filepath.Join(root, path)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func packTree(tw *tar.Writer, root, tree string) error {
+	return filepath.Walk(tree, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// Unpack extracts the gzipped tarball read from r into dstDir. Entries that
+// would end up outside of dstDir are rejected.
+func Unpack(r io.Reader, dstDir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := ValidatePath(hdr.Name); err != nil {
+			return fmt.Errorf("invalid archive entry: %v", hdr.Name)
+		}
+		dst := filepath.Join(dstDir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(dst, filepath.Clean(dstDir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid archive entry: %v", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0750); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+				os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
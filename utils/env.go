@@ -9,6 +9,7 @@ import (
 	"github.com/tchap/gocli"
 	"log"
 	"os"
+	"strconv"
 )
 
 func Getenv(value *string, key string) {
@@ -33,3 +34,56 @@ func GetenvOrFailNow(value *string, key string, cmd *gocli.Command) {
 
 	*value = v
 }
+
+func GetenvUint(value *uint, key string, cmd *gocli.Command) {
+	// In case the flag was used, we do not read the environment.
+	if *value != 0 {
+		return
+	}
+
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+
+	// Exit in case the value cannot be parsed.
+	n, err := strconv.ParseUint(v, 10, 0)
+	if err != nil {
+		log.Printf("Error: %v is not a valid unsigned integer: %v\n\n", key, v)
+		cmd.Usage()
+		os.Exit(2)
+	}
+
+	*value = uint(n)
+}
+
+func GetTokenOrFailNow(token *string, tokenFile string, key string, cmd *gocli.Command) {
+	// The token is read from these sources in the following order:
+	// the token flag, the token file flag, the environment variable
+	// and finally the token file environment variable.
+	read := func(path string) {
+		v, err := ReadTokenFile(path)
+		if err != nil {
+			log.Printf("Error: %v\n\n", err)
+			os.Exit(2)
+		}
+		*token = v
+	}
+
+	if *token == "" && tokenFile != "" {
+		read(tokenFile)
+	}
+	Getenv(token, key)
+	if *token == "" {
+		if path := os.Getenv(key + "_FILE"); path != "" {
+			read(path)
+		}
+	}
+
+	if *token == "" {
+		log.Printf("Error: neither %v nor %v_FILE is set and neither is the associated flag\n\n",
+			key, key)
+		cmd.Usage()
+		os.Exit(2)
+	}
+}
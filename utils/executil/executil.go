@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package executil runs commands that can be interrupted. It is based on
+// executil from meekod, but the way the commands are stopped is configurable.
+package executil
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Step is a single step of a Policy. Signal is sent to the process, then
+// the process is given Wait to exit before the next step is taken.
+type Step struct {
+	Signal os.Signal
+	Wait   time.Duration
+}
+
+// Policy defines how to stop a process once it is interrupted. The steps are
+// taken one after another until the process exits. Having the process still
+// running after the last step, Run just keeps waiting for it to exit.
+type Policy []Step
+
+// NewPolicy returns a policy that sends the signals in the given order,
+// waiting for delay in between.
+func NewPolicy(delay time.Duration, signals ...os.Signal) Policy {
+	policy := make(Policy, len(signals))
+	for i, signal := range signals {
+		policy[i] = Step{signal, delay}
+	}
+	return policy
+}
+
+// Result describes how the command was terminated.
+type Result struct {
+	// Signal is the last signal sent to the process before it exited.
+	// It is nil in case the process exited on its own.
+	Signal os.Signal
+
+	// Forced is set when the process did not exit until the last step of
+	// the policy was taken, which is usually SIGKILL.
+	Forced bool
+
+	// UserTime and SystemTime is the CPU time consumed by the process and
+	// its children that it waited for. These are zero in case the platform
+	// does not provide the information.
+	UserTime   time.Duration
+	SystemTime time.Duration
+}
+
+// exited fills in the resource usage once cmd.Wait has returned err.
+func (result *Result) exited(cmd *exec.Cmd, err error) (*Result, error) {
+	if state := cmd.ProcessState; state != nil {
+		result.UserTime = state.UserTime()
+		result.SystemTime = state.SystemTime()
+	}
+	return result, err
+}
+
+// Run runs the command using DefaultPolicy. It is a drop-in replacement for
+// the function of the same name from meekod.
+func Run(cmd *exec.Cmd, interrupted <-chan struct{}) error {
+	_, err := RunWithPolicy(cmd, interrupted, DefaultPolicy)
+	return err
+}
+
+// RunWithPolicy starts the command and waits for it to exit. Once interrupted
+// is closed, the process is stopped according to the policy. Where supported,
+// the command is started in a process group of its own and the signals are
+// sent to the whole group, so that the children of the process are stopped
+// as well, e.g. the commands run by a shell script.
+func RunWithPolicy(cmd *exec.Cmd, interrupted <-chan struct{}, policy Policy) (*Result, error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+
+	result := new(Result)
+	select {
+	case err := <-errCh:
+		return result.exited(cmd, err)
+	case <-interrupted:
+	}
+
+	for i, step := range policy {
+		if err := signalProcessGroup(cmd.Process, step.Signal); err != nil {
+			// The process may have exited in the meantime.
+			select {
+			case err := <-errCh:
+				return result.exited(cmd, err)
+			default:
+			}
+			return result, err
+		}
+		result.Signal = step.Signal
+		result.Forced = i == len(policy)-1
+
+		if i == len(policy)-1 {
+			break
+		}
+
+		select {
+		case err := <-errCh:
+			return result.exited(cmd, err)
+		case <-time.After(step.Wait):
+		}
+	}
+
+	return result.exited(cmd, <-errCh)
+}
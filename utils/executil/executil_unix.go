@@ -0,0 +1,42 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package executil
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// DefaultPolicy sends SIGINT, SIGTERM and finally SIGKILL, waiting for
+// 5 seconds in between.
+var DefaultPolicy = NewPolicy(5*time.Second, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+
+// NewDefaultPolicy returns DefaultPolicy with a custom delay.
+func NewDefaultPolicy(delay time.Duration) Policy {
+	return NewPolicy(delay, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+}
+
+// setProcessGroup makes the command start in a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends the signal to the process group led by process.
+func signalProcessGroup(process *os.Process, signal os.Signal) error {
+	sig, ok := signal.(syscall.Signal)
+	if !ok {
+		return process.Signal(signal)
+	}
+	return syscall.Kill(-process.Pid, sig)
+}
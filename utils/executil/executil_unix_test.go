@@ -0,0 +1,101 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package executil
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var testPolicy = NewDefaultPolicy(200 * time.Millisecond)
+
+// runInterrupted runs the shell script and interrupts it after a while,
+// so that the script has time to set up its traps.
+func runInterrupted(t *testing.T, script string) (*Result, time.Duration) {
+	cmd := exec.Command("sh", "-c", script)
+	interrupted := make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(interrupted) })
+
+	startT := time.Now()
+	result, _ := RunWithPolicy(cmd, interrupted, testPolicy)
+	if result == nil {
+		t.Fatal("no result returned")
+	}
+	return result, time.Since(startT)
+}
+
+func expectResult(t *testing.T, result *Result, signal os.Signal, forced bool) {
+	if result.Signal != signal {
+		t.Errorf("expected Signal %v, got %v", signal, result.Signal)
+	}
+	if result.Forced != forced {
+		t.Errorf("expected Forced %v, got %v", forced, result.Forced)
+	}
+}
+
+func TestRunWithPolicy_Exited(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "exit 0")
+	result, err := RunWithPolicy(cmd, make(chan struct{}), testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, result, nil, false)
+}
+
+func TestRunWithPolicy_Interrupted(t *testing.T) {
+	result, _ := runInterrupted(t, "sleep 10; true")
+	expectResult(t, result, syscall.SIGINT, false)
+}
+
+func TestRunWithPolicy_Escalated(t *testing.T) {
+	result, _ := runInterrupted(t, `trap "" INT; sleep 10; true`)
+	expectResult(t, result, syscall.SIGTERM, false)
+}
+
+func TestRunWithPolicy_Killed(t *testing.T) {
+	result, elapsed := runInterrupted(t, `trap "" INT TERM; sleep 10; true`)
+	expectResult(t, result, syscall.SIGKILL, true)
+	if elapsed > 5*time.Second {
+		t.Errorf("the children were not killed, the command took %v", elapsed)
+	}
+}
+
+func TestRunWithPolicy_ProcessGroup(t *testing.T) {
+	// The shell forks sleep, which inherits the write end of the pipe.
+	// The pipe is only closed once sleep exits as well.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command("sh", "-c", "sleep 10; true")
+	cmd.Stdout = w
+	interrupted := make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(interrupted) })
+
+	result, _ := RunWithPolicy(cmd, interrupted, testPolicy)
+	w.Close()
+	expectResult(t, result, syscall.SIGINT, false)
+
+	eofCh := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(r)
+		close(eofCh)
+	}()
+	select {
+	case <-eofCh:
+	case <-time.After(5 * time.Second):
+		t.Error("the children of the process were not signalled")
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package executil
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// DefaultPolicy just kills the process since Windows does not support
+// sending other signals.
+var DefaultPolicy = NewPolicy(0, os.Kill)
+
+// NewDefaultPolicy returns DefaultPolicy, the delay is not used on Windows.
+func NewDefaultPolicy(delay time.Duration) Policy {
+	return DefaultPolicy
+}
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup only signals the process itself on Windows.
+func signalProcessGroup(process *os.Process, signal os.Signal) error {
+	return process.Signal(signal)
+}
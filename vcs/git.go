@@ -0,0 +1,194 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package vcs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cider/cider/utils/executil"
+)
+
+type gitVCS struct {
+	scheme string
+	opts   *Options
+}
+
+func newGitVCS(scheme string, opts *Options) VCS {
+	return &gitVCS{scheme, opts}
+}
+
+func (vcs *gitVCS) Clone(repoURL *url.URL, srcDir string, ctx ActionContext) error {
+	// Assemble the cloning URL.
+	var buf bytes.Buffer
+	buf.WriteString(vcs.scheme)
+	buf.WriteString("://")
+	if repoURL.User != nil {
+		buf.WriteString(repoURL.User.String())
+		buf.WriteString("@")
+	}
+	buf.WriteString(repoURL.Host)
+	buf.WriteString(repoURL.Path)
+
+	// Assemble git flags and arguments.
+	branch := repoURL.Fragment
+	if branch == "" {
+		branch = "master"
+	}
+	args := []string{"clone", "--progress", "--branch", branch, "--single-branch"}
+	if vcs.opts.Depth != 0 {
+		args = append(args, "--depth", strconv.Itoa(vcs.opts.Depth))
+	}
+	// The shallow clones are never imported into the object store, so the
+	// objects they would borrow from the store could be pruned any time.
+	if vcs.opts.Reference != "" && vcs.opts.Depth == 0 {
+		args = append(args, "--reference", vcs.opts.Reference)
+	}
+	args = append(args, buf.String(), srcDir)
+
+	// Initialise the command.
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = newProgressWriter(ctx.Stderr(), vcs.opts.Progress)
+	cmd.Stdout = ctx.Stdout()
+
+	// Run the command.
+	if err := executil.Run(cmd, ctx.Interrupted()); err != nil {
+		return err
+	}
+	return vcs.updateSubmodules(srcDir, ctx)
+}
+
+func (vcs *gitVCS) Pull(repoURL *url.URL, srcDir string, ctx ActionContext) error {
+	branch := repoURL.Fragment
+	if branch == "" {
+		branch = "master"
+	}
+
+	// Fetch
+	args := []string{"fetch", "--progress"}
+	if vcs.opts.Depth != 0 {
+		args = append(args, "--depth", strconv.Itoa(vcs.opts.Depth))
+	}
+	args = append(args, "origin", branch)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = srcDir
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = newProgressWriter(ctx.Stderr(), vcs.opts.Progress)
+
+	if err := executil.Run(cmd, ctx.Interrupted()); err != nil {
+		return err
+	}
+
+	// The history fetched into a shallow clone is not connected to the commit
+	// checked out, so it cannot be merged. The branch is reset instead.
+	if vcs.opts.Depth != 0 {
+		cmd = exec.Command("git", "checkout", "-B", branch, "origin/"+branch)
+		cmd.Dir = srcDir
+		cmd.Stdout = ctx.Stdout()
+		cmd.Stderr = ctx.Stderr()
+
+		if err := executil.Run(cmd, ctx.Interrupted()); err != nil {
+			return err
+		}
+		return vcs.updateSubmodules(srcDir, ctx)
+	}
+
+	// Checkout
+	cmd = exec.Command("git", "checkout", branch)
+	cmd.Dir = srcDir
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = ctx.Stderr()
+
+	if err := executil.Run(cmd, ctx.Interrupted()); err != nil {
+		return err
+	}
+
+	// Merge
+	cmd = exec.Command("git", "merge", "origin/"+branch)
+	cmd.Dir = srcDir
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = ctx.Stderr()
+
+	if err := executil.Run(cmd, ctx.Interrupted()); err != nil {
+		return err
+	}
+	return vcs.updateSubmodules(srcDir, ctx)
+}
+
+// updateSubmodules checks out the submodules recorded in the commit checked
+// out, recursively, in case Options.Submodules is set.
+func (vcs *gitVCS) updateSubmodules(srcDir string, ctx ActionContext) error {
+	if !vcs.opts.Submodules {
+		return nil
+	}
+
+	cmd := exec.Command("git", "submodule", "update", "--init", "--recursive", "--progress")
+	cmd.Dir = srcDir
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = newProgressWriter(ctx.Stderr(), vcs.opts.Progress)
+
+	return executil.Run(cmd, ctx.Interrupted())
+}
+
+// Checksum hashes the checked out commit, the changes to the tracked files,
+// the names of the untracked files, the repository config and the hooks.
+// The contents of the untracked and ignored files are not covered.
+func (vcs *gitVCS) Checksum(srcDir string) (string, error) {
+	hash := sha256.New()
+	for _, args := range [][]string{
+		{"rev-parse", "HEAD"},
+		{"status", "--porcelain"},
+		{"diff", "HEAD", "--binary"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = srcDir
+		cmd.Stdout = hash
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("git %v failed: %v", args[0], err)
+		}
+	}
+
+	gitDir := filepath.Join(srcDir, ".git")
+	err := filepath.Walk(filepath.Join(gitDir, "hooks"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return hashFile(hash, gitDir, path)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := hashFile(hash, gitDir, filepath.Join(gitDir, "config")); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFile writes the path relative to root followed by the file content.
+func hashFile(w io.Writer, root, path string) error {
+	name, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	io.WriteString(w, filepath.ToSlash(name)+"\n")
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package vcs
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+type testContext struct{}
+
+func (ctx testContext) SignalProgress() error        { return nil }
+func (ctx testContext) Stdout() io.Writer            { return ioutil.Discard }
+func (ctx testContext) Stderr() io.Writer            { return ioutil.Discard }
+func (ctx testContext) Interrupted() <-chan struct{} { return nil }
+
+func TestGitClone_ShallowSurvivesPrune(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	root, err := ioutil.TempDir("", "cider-vcs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	run := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=cider", "GIT_AUTHOR_EMAIL=cider@localhost",
+			"GIT_COMMITTER_NAME=cider", "GIT_COMMITTER_EMAIL=cider@localhost")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	// Create the origin repository with some history.
+	origin := filepath.Join(root, "origin")
+	run(root, "init", "--quiet", origin)
+	run(origin, "checkout", "--quiet", "-b", "master")
+	for _, content := range []string{"one", "two", "three"} {
+		if err := ioutil.WriteFile(filepath.Join(origin, "file"), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		run(origin, "add", "file")
+		run(origin, "commit", "--quiet", "-m", content)
+	}
+	repoURL := &url.URL{Scheme: "git+file", Path: origin}
+
+	// Populate the object store using a full clone.
+	store, err := OpenObjectStore(filepath.Join(root, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(root, "full")
+	err = newGitVCS("file", &Options{Reference: store.Dir()}).Clone(repoURL, full, testContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Import(full, "full"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clone shallow, then drop the full clone and prune the store.
+	shallow := filepath.Join(root, "shallow")
+	opts := &Options{Reference: store.Dir(), Depth: 1}
+	if err := newGitVCS("file", opts).Clone(repoURL, shallow, testContext{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Remove("full"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	run(shallow, "fsck", "--no-progress")
+	run(shallow, "checkout", "--quiet", "--force", "HEAD")
+}
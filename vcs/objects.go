@@ -0,0 +1,116 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package vcs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// ObjectStore is a bare git repository that is shared by all the git
+// workspaces of a build slave. New clones are created using --reference,
+// so the objects already present in the store are not downloaded again
+// and they are not duplicated on the disk either.
+//
+// The store is populated by importing the branches of the workspaces after
+// every checkout. Every workspace gets its own ref namespace, so the objects
+// the workspaces depend on are always reachable. Git never prunes objects
+// from the store on its own since automatic gc is disabled for the store.
+// The namespace of a workspace is deleted using Remove once the workspace
+// sources are removed, then the objects can be dropped using Prune. Pruning
+// is only safe while no workspace is being checked out, since the objects
+// borrowed by a checkout are not reachable from the store until imported.
+// The same applies to running git gc manually.
+type ObjectStore struct {
+	dir string
+	mu  *sync.Mutex
+}
+
+// OpenObjectStore opens the store located at dir. The store is initialised
+// in case it does not exist yet.
+func OpenObjectStore(dir string) (*ObjectStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := git("", "init", "--quiet", "--bare", dir); err != nil {
+			return nil, err
+		}
+		if err := git(dir, "config", "gc.auto", "0"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ObjectStore{dir, new(sync.Mutex)}, nil
+}
+
+// Dir returns the path to the store, which can be used as Options.Reference.
+func (store *ObjectStore) Dir() string {
+	return store.dir
+}
+
+// Import fetches all the branches of the repository located at srcDir into
+// the store. The branches are stored under refs/cider/<name>/.
+func (store *ObjectStore) Import(srcDir, name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	refspec := fmt.Sprintf("+refs/heads/*:refs/cider/%v/*", name)
+	return git(store.dir, "fetch", "--quiet", srcDir, refspec)
+}
+
+// Remove deletes the refs imported under the given name. It returns false
+// in case there were no such refs.
+func (store *ObjectStore) Remove(name string) (removed bool, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	commands, err := gitIO(store.dir, nil,
+		"for-each-ref", "--format=delete %(refname)", fmt.Sprintf("refs/cider/%v/", name))
+	if err != nil || len(commands) == 0 {
+		return false, err
+	}
+	if _, err := gitIO(store.dir, commands, "update-ref", "--stdin"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Prune drops the objects not reachable from the store refs. The caller must
+// make sure that no workspace is being checked out, see ObjectStore.
+func (store *ObjectStore) Prune() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return git(store.dir, "gc", "--quiet", "--prune=now")
+}
+
+func git(gitDir string, args ...string) error {
+	_, err := gitIO(gitDir, nil, args...)
+	return err
+}
+
+// gitIO runs git with stdin connected to input and returns stdout.
+func gitIO(gitDir string, input []byte, args ...string) ([]byte, error) {
+	if gitDir != "" {
+		args = append([]string{"--git-dir", gitDir}, args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %v: %v: %v", args, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
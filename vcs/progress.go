@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package vcs
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gitProgressRegexp matches the progress lines printed by git --progress,
+// e.g. "Receiving objects:  45% (450/1000), 1.20 MiB | 500.00 KiB/s".
+// Some git versions prefix the lines with "remote: ".
+var gitProgressRegexp = regexp.MustCompile(`^(?:remote: )?([A-Za-z][A-Za-z ]*):\s+(\d{1,3})%`)
+
+// progressWriter passes the git output on unchanged while reporting the git
+// progress lines using report, see Options.Progress.
+type progressWriter struct {
+	w      io.Writer
+	report func(phase string, percent int)
+	line   []byte
+	last   progress
+	mu     *sync.Mutex
+}
+
+type progress struct {
+	phase   string
+	percent int
+}
+
+func newProgressWriter(w io.Writer, report func(phase string, percent int)) io.Writer {
+	if report == nil {
+		return w
+	}
+	return &progressWriter{w: w, report: report, mu: new(sync.Mutex)}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for _, b := range p {
+		// git terminates the updated progress lines using \r.
+		if b == '\r' || b == '\n' {
+			pw.parseLine()
+			continue
+		}
+		if len(pw.line) < 256 {
+			pw.line = append(pw.line, b)
+		}
+	}
+	return n, err
+}
+
+func (pw *progressWriter) parseLine() {
+	defer func() {
+		pw.line = pw.line[:0]
+	}()
+
+	match := gitProgressRegexp.FindSubmatch(pw.line)
+	if match == nil {
+		return
+	}
+	percent, err := strconv.Atoi(string(match[2]))
+	if err != nil || percent > 100 {
+		return
+	}
+	current := progress{strings.ToLower(string(match[1])), percent}
+
+	// Only report the changes, git updates the lines quite often.
+	if current == pw.last {
+		return
+	}
+	pw.last = current
+	pw.report(current.phase, current.percent)
+}
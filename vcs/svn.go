@@ -0,0 +1,60 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+package vcs
+
+import (
+	"net/url"
+	"os/exec"
+
+	"github.com/cider/cider/utils/executil"
+)
+
+// svnVCS checks out Subversion repositories.
+//
+// The repository URL is passed to svn as it is, without the fragment,
+// so it is supposed to point to the directory to be checked out, e.g.
+// svn+ssh://svn.example.com/project/trunk. The fragment, if present,
+// is the revision to be checked out, otherwise HEAD is used. The revision
+// can be anything svn accepts using -r, e.g. 1234 or {2014-08-01}.
+type svnVCS struct {
+	opts *Options
+}
+
+func newSvnVCS(opts *Options) VCS {
+	return &svnVCS{opts}
+}
+
+func (vcs *svnVCS) Clone(repoURL *url.URL, srcDir string, ctx ActionContext) error {
+	u := *repoURL
+	u.Fragment = ""
+
+	args := append([]string{"checkout", "--non-interactive"}, svnRevision(repoURL)...)
+	args = append(args, u.String(), srcDir)
+
+	cmd := exec.Command("svn", args...)
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = ctx.Stderr()
+
+	return executil.Run(cmd, ctx.Interrupted())
+}
+
+func (vcs *svnVCS) Pull(repoURL *url.URL, srcDir string, ctx ActionContext) error {
+	args := append([]string{"update", "--non-interactive"}, svnRevision(repoURL)...)
+
+	cmd := exec.Command("svn", args...)
+	cmd.Dir = srcDir
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = ctx.Stderr()
+
+	return executil.Run(cmd, ctx.Interrupted())
+}
+
+func svnRevision(repoURL *url.URL) []string {
+	if repoURL.Fragment == "" {
+		return nil
+	}
+	return []string{"-r", repoURL.Fragment}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The cider AUTHORS
+//
+// Use of this source code is governed by the MIT license
+// that can be found in the LICENSE file.
+
+// Package vcs implements the version control operations used by the build
+// slaves. It started as a copy of vcsutil from meekod, but it supports
+// additional options that the build slaves need.
+package vcs
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+type VCS interface {
+	Clone(repoURL *url.URL, srcDir string, ctx ActionContext) error
+	Pull(repoURL *url.URL, srcDir string, ctx ActionContext) error
+}
+
+// Checksummer is implemented by the VCS that can compute a checksum of
+// the checked out sources, which is used to detect the sources being modified
+// between the builds.
+type Checksummer interface {
+	Checksum(srcDir string) (string, error)
+}
+
+type ActionContext interface {
+	SignalProgress() error
+	Stdout() io.Writer
+	Stderr() io.Writer
+	Interrupted() <-chan struct{}
+}
+
+// Options can be used to modify the behaviour of the VCS operations.
+// The options that are not supported by the given VCS are ignored.
+type Options struct {
+	// Reference is the path to a git repository that is used as the object
+	// store for new clones. See ObjectStore for more details. It is ignored
+	// for the shallow clones, which are not imported into the store.
+	Reference string
+
+	// Depth makes the clones shallow, truncated to the given number of
+	// commits. The pulls fetch only that many commits as well, so that
+	// the clones never get unshallowed. Zero means the full history.
+	Depth int
+
+	// Submodules makes the VCS check out the submodules, recursively,
+	// once the sources are cloned or pulled. Only git supports this.
+	Submodules bool
+
+	// Progress is called to report the progress of the git operations,
+	// e.g. with "receiving objects" and 45. Nothing is reported when nil.
+	Progress func(phase string, percent int)
+}
+
+// schemes lists the supported repository URL schemes and the VCS handling
+// every scheme. It is the only place the schemes are defined, the build
+// arguments are validated using SupportedSchemes as well.
+var schemes = []struct {
+	scheme string
+	kind   string
+	newVCS func(opts *Options) VCS
+}{
+	{"git+ssh", "git", func(opts *Options) VCS { return newGitVCS("ssh", opts) }},
+	{"git+https", "git", func(opts *Options) VCS { return newGitVCS("https", opts) }},
+	{"git+file", "git", func(opts *Options) VCS { return newGitVCS("file", opts) }},
+	{"svn", "svn", newSvnVCS},
+	{"svn+ssh", "svn", newSvnVCS},
+}
+
+// SupportedSchemes returns the repository URL schemes accepted by GetVCS.
+func SupportedSchemes() []string {
+	supported := make([]string, len(schemes))
+	for i, s := range schemes {
+		supported[i] = s.scheme
+	}
+	return supported
+}
+
+// Kind returns the name of the version control system used for the scheme,
+// i.e. git or svn. It returns an empty string for unknown schemes.
+func Kind(scheme string) string {
+	for _, s := range schemes {
+		if s.scheme == scheme {
+			return s.kind
+		}
+	}
+	return ""
+}
+
+func GetVCS(scheme string, opts *Options) (VCS, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	for _, s := range schemes {
+		if s.scheme == scheme {
+			return s.newVCS(opts), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown vcs scheme: %s (supported: %v)",
+		scheme, strings.Join(SupportedSchemes(), ", "))
+}